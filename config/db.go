@@ -77,7 +77,9 @@ func createTables() error {
 			product_description TEXT,
 			product_price DECIMAL(10,2) NOT NULL,
 			product_images TEXT[],
-			compressed_product_images TEXT[],
+			compressed_product_images JSONB DEFAULT '{}',
+			image_records JSONB DEFAULT '[]',
+			last_job_id BIGINT,
 			created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
 			updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
 			FOREIGN KEY (user_id) REFERENCES users(user_id)
@@ -87,6 +89,114 @@ func createTables() error {
 		return fmt.Errorf("error creating products table: %v", err)
 	}
 
+	// older databases stored a flat TEXT[] of 800x600 images, keep them as the card rendition
+	_, err = DB.Exec(`
+		DO $$
+		BEGIN
+			IF EXISTS (
+				SELECT 1 FROM information_schema.columns
+				WHERE table_name = 'products'
+					AND column_name = 'compressed_product_images'
+					AND data_type = 'ARRAY'
+			) THEN
+				ALTER TABLE products
+					ALTER COLUMN compressed_product_images TYPE JSONB
+					USING CASE
+						WHEN compressed_product_images IS NULL THEN '{}'::jsonb
+						ELSE jsonb_build_object('card', to_jsonb(compressed_product_images))
+					END;
+				ALTER TABLE products ALTER COLUMN compressed_product_images SET DEFAULT '{}';
+			END IF;
+		END $$
+	`)
+	if err != nil {
+		return fmt.Errorf("error migrating compressed_product_images: %v", err)
+	}
+
+	_, err = DB.Exec(`ALTER TABLE products ADD COLUMN IF NOT EXISTS image_records JSONB DEFAULT '[]'`)
+	if err != nil {
+		return fmt.Errorf("error adding image_records column: %v", err)
+	}
+
+	// newest processing job whose results are on the product
+	_, err = DB.Exec(`ALTER TABLE products ADD COLUMN IF NOT EXISTS last_job_id BIGINT`)
+	if err != nil {
+		return fmt.Errorf("error adding last_job_id column: %v", err)
+	}
+
+	// messages written with product changes, published by the outbox relay
+	_, err = DB.Exec(`
+		CREATE TABLE IF NOT EXISTS outbox (
+			id BIGSERIAL PRIMARY KEY,
+			queue VARCHAR(255) NOT NULL,
+			payload JSONB NOT NULL,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			last_error TEXT,
+			created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+			sent_at TIMESTAMP WITH TIME ZONE
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("error creating outbox table: %v", err)
+	}
+
+	// one row per image processing run, written with the outbox message
+	_, err = DB.Exec(`
+		CREATE TABLE IF NOT EXISTS processing_jobs (
+			id BIGSERIAL PRIMARY KEY,
+			product_id INTEGER NOT NULL,
+			status VARCHAR(20) NOT NULL,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			last_error TEXT,
+			image_records JSONB,
+			created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+			published_at TIMESTAMP WITH TIME ZONE,
+			started_at TIMESTAMP WITH TIME ZONE,
+			finished_at TIMESTAMP WITH TIME ZONE,
+			updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("error creating processing_jobs table: %v", err)
+	}
+
+	_, err = DB.Exec(`CREATE INDEX IF NOT EXISTS processing_jobs_product_idx ON processing_jobs (product_id)`)
+	if err != nil {
+		return fmt.Errorf("error creating processing_jobs index: %v", err)
+	}
+
+	_, err = DB.Exec(`ALTER TABLE outbox ADD COLUMN IF NOT EXISTS job_id BIGINT`)
+	if err != nil {
+		return fmt.Errorf("error adding outbox job_id column: %v", err)
+	}
+
+	_, err = DB.Exec(`ALTER TABLE outbox ADD COLUMN IF NOT EXISTS message_id VARCHAR(64)`)
+	if err != nil {
+		return fmt.Errorf("error adding outbox message_id column: %v", err)
+	}
+
+	// failed rows wait for next_attempt_at, given up rows get failed_at
+	_, err = DB.Exec(`ALTER TABLE outbox ADD COLUMN IF NOT EXISTS next_attempt_at TIMESTAMP WITH TIME ZONE`)
+	if err != nil {
+		return fmt.Errorf("error adding outbox next_attempt_at column: %v", err)
+	}
+
+	_, err = DB.Exec(`ALTER TABLE outbox ADD COLUMN IF NOT EXISTS failed_at TIMESTAMP WITH TIME ZONE`)
+	if err != nil {
+		return fmt.Errorf("error adding outbox failed_at column: %v", err)
+	}
+
+	// rows a relay is publishing right now, others skip them until then
+	_, err = DB.Exec(`ALTER TABLE outbox ADD COLUMN IF NOT EXISTS locked_until TIMESTAMP WITH TIME ZONE`)
+	if err != nil {
+		return fmt.Errorf("error adding outbox locked_until column: %v", err)
+	}
+
+	_, err = DB.Exec(`CREATE INDEX IF NOT EXISTS outbox_unsent_idx ON outbox (id) WHERE sent_at IS NULL`)
+	if err != nil {
+		return fmt.Errorf("error creating outbox index: %v", err)
+	}
+
 	// insert a test user if no users exist
 	var count int
 	err = DB.QueryRow("SELECT COUNT(*) FROM users").Scan(&count)
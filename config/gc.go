@@ -0,0 +1,30 @@
+package config
+
+import (
+	"log"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+// settings for the orphaned S3 object collector, an interval of 0 disables it
+var (
+	GCInterval    time.Duration
+	GCGracePeriod = 24 * time.Hour
+	GCDryRun      = true
+)
+
+func InitGC() {
+	err := godotenv.Load()
+	if err != nil {
+		log.Fatalf("Error loading .env file: %v", err)
+	}
+
+	GCInterval = getEnvDuration("GC_INTERVAL", 0)
+	GCGracePeriod = getEnvDuration("GC_GRACE_PERIOD", GCGracePeriod)
+	GCDryRun = getEnvBool("GC_DRY_RUN", GCDryRun)
+
+	if GCInterval > 0 {
+		log.Printf("Orphaned object collection every %s (grace %s, dry run %t)", GCInterval, GCGracePeriod, GCDryRun)
+	}
+}
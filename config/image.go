@@ -0,0 +1,198 @@
+package config
+
+import (
+	"AsyncProd/pkg/image"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+// limits for images uploaded directly to the API
+var (
+	UploadMaxBytes      int64 = 10 << 20
+	UploadMaxFiles            = 10
+	UploadPresignExpiry       = 15 * time.Minute
+)
+
+// images of a single queue message processed at the same time
+var ImageParallelism = 4
+
+// what a job counts as when some of its images fail
+const (
+	FailurePolicySuccess = "success"
+	FailurePolicyRetry   = "retry"
+	FailurePolicyFail    = "fail"
+)
+
+// PartialFailurePolicy applies when some images succeeded, one of the
+// policies above. TotalFailurePolicy applies when none did, retry or fail.
+var (
+	PartialFailurePolicy = FailurePolicySuccess
+	TotalFailurePolicy   = FailurePolicyFail
+)
+
+func InitImage() {
+	err := godotenv.Load()
+	if err != nil {
+		log.Fatalf("Error loading .env file: %v", err)
+	}
+
+	// e.g. IMAGE_RENDITIONS=thumbnail:150x150:70,card:800x600:75,zoom:1600x1200:85:jpg
+	if spec := os.Getenv("IMAGE_RENDITIONS"); spec != "" {
+		renditions, err := parseRenditions(spec)
+		if err != nil {
+			log.Fatalf("Invalid IMAGE_RENDITIONS: %v", err)
+		}
+		image.Renditions = renditions
+	}
+
+	// e.g. IMAGE_OUTPUT_FORMATS=png:png,jpeg:jpeg
+	if spec := os.Getenv("IMAGE_OUTPUT_FORMATS"); spec != "" {
+		formats, err := parseOutputFormats(spec)
+		if err != nil {
+			log.Fatalf("Invalid IMAGE_OUTPUT_FORMATS: %v", err)
+		}
+		image.OutputFormats = formats
+	}
+	if format := os.Getenv("IMAGE_DEFAULT_OUTPUT_FORMAT"); format != "" {
+		format = image.NormalizeFormat(format)
+		if !isEncodableFormat(format) {
+			log.Fatalf("Invalid IMAGE_DEFAULT_OUTPUT_FORMAT: %s", format)
+		}
+		image.DefaultOutputFormat = format
+	}
+
+	// e.g. IMAGE_METADATA_ALLOWLIST=Copyright,Artist
+	if allowlist := os.Getenv("IMAGE_METADATA_ALLOWLIST"); allowlist != "" {
+		var names []string
+		for _, name := range strings.Split(allowlist, ",") {
+			name = strings.TrimSpace(name)
+			if _, ok := image.KeepableMetadata[name]; !ok {
+				log.Fatalf("Invalid IMAGE_METADATA_ALLOWLIST: %s can't be kept", name)
+			}
+			names = append(names, name)
+		}
+		image.MetadataAllowlist = names
+	}
+
+	image.DefaultFetcher = image.NewFetcher(image.FetcherConfig{
+		ConnectTimeout:       getEnvDuration("IMAGE_FETCH_CONNECT_TIMEOUT", image.DefaultFetcherConfig.ConnectTimeout),
+		ReadTimeout:          getEnvDuration("IMAGE_FETCH_READ_TIMEOUT", image.DefaultFetcherConfig.ReadTimeout),
+		MaxBytes:             getEnvInt64("IMAGE_FETCH_MAX_BYTES", image.DefaultFetcherConfig.MaxBytes),
+		MaxRedirects:         getEnvInt("IMAGE_FETCH_MAX_REDIRECTS", image.DefaultFetcherConfig.MaxRedirects),
+		AllowedSchemes:       getEnvList("IMAGE_FETCH_ALLOWED_SCHEMES", image.DefaultFetcherConfig.AllowedSchemes),
+		AllowPrivateNetworks: getEnvBool("IMAGE_FETCH_ALLOW_PRIVATE_NETWORKS", false),
+	})
+
+	// file:// image sources are only read below this directory
+	image.FileSourceRoot = os.Getenv("IMAGE_FILE_ROOT")
+	image.AllowedSources = getEnvList("IMAGE_SOURCE_SCHEMES", image.AllowedSources)
+
+	image.MaxPixels = getEnvInt64("IMAGE_MAX_PIXELS", image.MaxPixels)
+	image.MaxSide = getEnvInt("IMAGE_MAX_SIDE", image.MaxSide)
+	if image.MaxPixels < 1 || image.MaxSide < 1 {
+		log.Fatalf("Invalid image dimension limits: IMAGE_MAX_PIXELS %d and IMAGE_MAX_SIDE %d must be at least 1", image.MaxPixels, image.MaxSide)
+	}
+	if limit := getEnvInt64("IMAGE_DECODE_MEMORY_LIMIT", 0); limit > 0 {
+		image.SetDecodeMemoryLimit(limit)
+	}
+
+	ImageParallelism = getEnvInt("IMAGE_PARALLELISM", ImageParallelism)
+	if ImageParallelism < 1 {
+		log.Fatalf("Invalid IMAGE_PARALLELISM: must be at least 1")
+	}
+
+	if policy := os.Getenv("IMAGE_PARTIAL_FAILURE_POLICY"); policy != "" {
+		if policy != FailurePolicySuccess && policy != FailurePolicyRetry && policy != FailurePolicyFail {
+			log.Fatalf("Invalid IMAGE_PARTIAL_FAILURE_POLICY %q: expected success, retry or fail", policy)
+		}
+		PartialFailurePolicy = policy
+	}
+	if policy := os.Getenv("IMAGE_TOTAL_FAILURE_POLICY"); policy != "" {
+		if policy != FailurePolicyRetry && policy != FailurePolicyFail {
+			log.Fatalf("Invalid IMAGE_TOTAL_FAILURE_POLICY %q: expected retry or fail", policy)
+		}
+		TotalFailurePolicy = policy
+	}
+
+	UploadMaxBytes = getEnvInt64("UPLOAD_MAX_BYTES", UploadMaxBytes)
+	UploadMaxFiles = getEnvInt("UPLOAD_MAX_FILES", UploadMaxFiles)
+	UploadPresignExpiry = getEnvDuration("UPLOAD_PRESIGN_EXPIRY", UploadPresignExpiry)
+
+	log.Printf("Image renditions configured: %d", len(image.Renditions))
+}
+
+// parses name:WIDTHxHEIGHT:quality[:format] entries separated by commas
+func parseRenditions(spec string) ([]image.Rendition, error) {
+	var renditions []image.Rendition
+	seen := make(map[string]bool)
+
+	for _, entry := range strings.Split(spec, ",") {
+		parts := strings.Split(strings.TrimSpace(entry), ":")
+		if len(parts) < 3 || len(parts) > 4 {
+			return nil, fmt.Errorf("expected name:WxH:quality[:format], got %q", entry)
+		}
+
+		name := parts[0]
+		if name == "" || seen[name] {
+			return nil, fmt.Errorf("missing or duplicate rendition name in %q", entry)
+		}
+		seen[name] = true
+
+		dims := strings.Split(parts[1], "x")
+		if len(dims) != 2 {
+			return nil, fmt.Errorf("invalid dimensions in %q", entry)
+		}
+		width, err := strconv.Atoi(dims[0])
+		if err != nil || width <= 0 {
+			return nil, fmt.Errorf("invalid width in %q", entry)
+		}
+		height, err := strconv.Atoi(dims[1])
+		if err != nil || height <= 0 {
+			return nil, fmt.Errorf("invalid height in %q", entry)
+		}
+		quality, err := strconv.Atoi(parts[2])
+		if err != nil || quality < 1 || quality > 100 {
+			return nil, fmt.Errorf("invalid quality in %q", entry)
+		}
+
+		r := image.Rendition{Name: name, MaxWidth: width, MaxHeight: height, Quality: quality}
+		if len(parts) == 4 {
+			r.Format = image.NormalizeFormat(parts[3])
+			if !isEncodableFormat(r.Format) {
+				return nil, fmt.Errorf("unsupported output format in %q", entry)
+			}
+		}
+		renditions = append(renditions, r)
+	}
+
+	return renditions, nil
+}
+
+// parses input:output format pairs separated by commas
+func parseOutputFormats(spec string) (map[string]string, error) {
+	formats := make(map[string]string)
+
+	for _, entry := range strings.Split(spec, ",") {
+		parts := strings.Split(strings.TrimSpace(entry), ":")
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("expected input:output, got %q", entry)
+		}
+		output := image.NormalizeFormat(parts[1])
+		if !isEncodableFormat(output) {
+			return nil, fmt.Errorf("unsupported output format in %q", entry)
+		}
+		formats[image.NormalizeFormat(parts[0])] = output
+	}
+
+	return formats, nil
+}
+
+func isEncodableFormat(format string) bool {
+	return format == "jpeg" || format == "png" || format == image.AutoFormat
+}
@@ -0,0 +1,52 @@
+package config
+
+import (
+	"log"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+// settings for the relay that publishes outbox messages
+var (
+	OutboxPollInterval = time.Second
+	OutboxBatchSize    = 100
+	OutboxRetention    = 24 * time.Hour
+	// failed publishes of a row are retried with exponential backoff, after
+	// OutboxMaxAttempts the row is given up and its job is dead
+	OutboxMaxAttempts    = 10
+	OutboxRetryBaseDelay = 5 * time.Second
+	OutboxRetryMaxDelay  = 10 * time.Minute
+)
+
+// delay before a row is published again, attempts counts failed publishes
+func OutboxRetryDelay(attempts int) time.Duration {
+	delay := OutboxRetryBaseDelay
+	for i := 1; i < attempts && delay < OutboxRetryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > OutboxRetryMaxDelay {
+		delay = OutboxRetryMaxDelay
+	}
+	return delay
+}
+
+func InitOutbox() {
+	err := godotenv.Load()
+	if err != nil {
+		log.Fatalf("Error loading .env file: %v", err)
+	}
+
+	OutboxPollInterval = getEnvDuration("OUTBOX_POLL_INTERVAL", OutboxPollInterval)
+	OutboxBatchSize = getEnvInt("OUTBOX_BATCH_SIZE", OutboxBatchSize)
+	OutboxRetention = getEnvDuration("OUTBOX_RETENTION", OutboxRetention)
+	OutboxMaxAttempts = getEnvInt("OUTBOX_MAX_ATTEMPTS", OutboxMaxAttempts)
+	OutboxRetryBaseDelay = getEnvDuration("OUTBOX_RETRY_BASE_DELAY", OutboxRetryBaseDelay)
+	OutboxRetryMaxDelay = getEnvDuration("OUTBOX_RETRY_MAX_DELAY", OutboxRetryMaxDelay)
+	if OutboxPollInterval <= 0 || OutboxBatchSize < 1 {
+		log.Fatalf("Invalid outbox settings: poll interval %s, batch size %d", OutboxPollInterval, OutboxBatchSize)
+	}
+	if OutboxMaxAttempts < 1 || OutboxRetryBaseDelay <= 0 || OutboxRetryMaxDelay < OutboxRetryBaseDelay {
+		log.Fatalf("Invalid outbox retry settings: max attempts %d, delays %s to %s", OutboxMaxAttempts, OutboxRetryBaseDelay, OutboxRetryMaxDelay)
+	}
+}
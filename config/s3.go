@@ -1,8 +1,13 @@
 package config
 
 import (
+	"crypto/tls"
+	"fmt"
 	"log"
+	"net/http"
+	"net/url"
 	"os"
+	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
@@ -15,6 +20,10 @@ var (
 	S3Session *session.Session
 	S3Client  *s3.S3
 	S3Bucket  string
+
+	// S3PublicBaseURL is what stored object URLs start with, e.g. a CDN
+	// in front of the bucket
+	S3PublicBaseURL string
 )
 
 func InitS3() {
@@ -28,14 +37,43 @@ func InitS3() {
 	region := os.Getenv("AWS_REGION")
 	S3Bucket = os.Getenv("AWS_S3_BUCKET")
 
-	S3Session, err = session.NewSession(&aws.Config{
+	// S3 compatible stores such as MinIO
+	endpoint := os.Getenv("AWS_S3_ENDPOINT")
+	forcePathStyle := getEnvBool("AWS_S3_FORCE_PATH_STYLE", false)
+	disableSSL := getEnvBool("AWS_S3_DISABLE_SSL", false)
+	insecureSkipVerify := getEnvBool("AWS_S3_INSECURE_SKIP_VERIFY", false)
+
+	awsConfig := &aws.Config{
 		Region: aws.String(region),
 		Credentials: credentials.NewStaticCredentials(
 			accessKey,
 			secretKey,
 			"",
 		),
-	})
+		S3ForcePathStyle: aws.Bool(forcePathStyle),
+		DisableSSL:       aws.Bool(disableSSL),
+	}
+	if endpoint != "" {
+		awsConfig.Endpoint = aws.String(endpoint)
+	}
+	if insecureSkipVerify {
+		// for self-signed certificates on local deployments only
+		awsConfig.HTTPClient = &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			},
+		}
+	}
+
+	S3PublicBaseURL = strings.TrimSuffix(os.Getenv("AWS_S3_PUBLIC_BASE_URL"), "/")
+	if S3PublicBaseURL == "" {
+		S3PublicBaseURL, err = defaultS3BaseURL(region, endpoint, forcePathStyle, disableSSL)
+		if err != nil {
+			log.Fatalf("Invalid AWS_S3_ENDPOINT: %v", err)
+		}
+	}
+
+	S3Session, err = session.NewSession(awsConfig)
 	if err != nil {
 		log.Fatalf("Failed to create AWS session: %v", err)
 	}
@@ -43,4 +81,34 @@ func InitS3() {
 	S3Client = s3.New(S3Session)
 
 	log.Println("Initialized AWS S3 session successfully")
-}
\ No newline at end of file
+}
+
+// where objects are reachable when no public base URL is configured
+func defaultS3BaseURL(region, endpoint string, forcePathStyle, disableSSL bool) (string, error) {
+	if endpoint == "" {
+		if forcePathStyle {
+			return fmt.Sprintf("https://s3.%s.amazonaws.com/%s", region, S3Bucket), nil
+		}
+		return fmt.Sprintf("https://%s.s3.amazonaws.com", S3Bucket), nil
+	}
+
+	if !strings.Contains(endpoint, "://") {
+		scheme := "https"
+		if disableSSL {
+			scheme = "http"
+		}
+		endpoint = scheme + "://" + endpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("missing host in %q", endpoint)
+	}
+
+	if forcePathStyle {
+		return fmt.Sprintf("%s://%s/%s", u.Scheme, u.Host, S3Bucket), nil
+	}
+	return fmt.Sprintf("%s://%s.%s", u.Scheme, S3Bucket, u.Host), nil
+}
@@ -0,0 +1,96 @@
+package config
+
+import (
+	"AsyncProd/pkg/blobstore"
+	"log"
+	"os"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+// route the local and memory backends serve their objects from
+const BlobRoute = "/blobs"
+
+// Blob is where originals and renditions are stored
+var Blob blobstore.BlobStore
+
+// in private mode only object keys are stored and reads get presigned URLs
+var (
+	StoragePrivate   bool
+	SignedURLExpiry  = 15 * time.Minute
+	SignedURLCaching bool
+)
+
+// attributes of uploaded objects, keys are never rewritten with new
+// content so they can be cached forever
+var (
+	StorageCacheControl = "public, max-age=31536000, immutable"
+	StorageClass        string
+)
+
+// earlier base URLs of stored objects, e.g. the raw bucket URL from
+// before a CDN was put in front of it
+var StorageURLAliases []string
+
+// picks the storage backend, has to run after InitS3
+func InitStorage() {
+	err := godotenv.Load()
+	if err != nil {
+		log.Fatalf("Error loading .env file: %v", err)
+	}
+
+	backend := os.Getenv("STORAGE_BACKEND")
+	if backend == "" {
+		backend = "s3"
+	}
+	publicURL := os.Getenv("STORAGE_PUBLIC_URL")
+	if publicURL == "" {
+		publicURL = "http://localhost:8080" + BlobRoute
+	}
+
+	StoragePrivate = getEnvBool("STORAGE_PRIVATE", false)
+	SignedURLExpiry = getEnvDuration("SIGNED_URL_EXPIRY", SignedURLExpiry)
+	SignedURLCaching = getEnvBool("SIGNED_URL_CACHE", false)
+
+	if StoragePrivate {
+		// shared caches must not keep objects handed out through signed URLs
+		StorageCacheControl = "private, max-age=31536000, immutable"
+	}
+	if value := os.Getenv("STORAGE_CACHE_CONTROL"); value != "" {
+		StorageCacheControl = value
+	}
+	StorageClass = os.Getenv("STORAGE_CLASS")
+
+	StorageURLAliases = getEnvList("STORAGE_URL_ALIASES", nil)
+	if backend == "s3" && S3Bucket != "" {
+		// URLs stored before custom endpoints and CDNs were supported
+		StorageURLAliases = append(StorageURLAliases, "https://"+S3Bucket+".s3.amazonaws.com")
+	}
+
+	switch backend {
+	case "s3":
+		Blob = blobstore.NewS3Store(S3Client, S3Bucket, S3PublicBaseURL)
+	case "local":
+		dir := os.Getenv("LOCAL_STORAGE_DIR")
+		if dir == "" {
+			dir = "./data/blobs"
+		}
+		Blob, err = blobstore.NewLocalStore(dir, publicURL)
+		if err != nil {
+			log.Fatalf("Failed to initialize local storage: %v", err)
+		}
+	case "memory":
+		Blob = blobstore.NewMemoryStore(publicURL)
+	default:
+		log.Fatalf("Unknown STORAGE_BACKEND: %s", backend)
+	}
+
+	if StoragePrivate {
+		if _, ok := Blob.(blobstore.Presigner); !ok {
+			log.Printf("WARNING: %s storage can't presign, private mode serves plain URLs", backend)
+		}
+	}
+
+	log.Printf("Using %s storage backend (private: %t)", backend, StoragePrivate)
+}
@@ -10,7 +10,42 @@ CREATE TABLE products (
     product_description TEXT,
     product_price DECIMAL(10,2) NOT NULL,
     product_images TEXT[],
-    compressed_product_images TEXT[],
+    compressed_product_images JSONB DEFAULT '{}',
+    image_records JSONB DEFAULT '[]',
+    last_job_id BIGINT,
     created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
     updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
-);
\ No newline at end of file
+);
+
+CREATE TABLE processing_jobs (
+    id BIGSERIAL PRIMARY KEY,
+    product_id INTEGER NOT NULL,
+    status VARCHAR(20) NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT,
+    image_records JSONB,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    published_at TIMESTAMP WITH TIME ZONE,
+    started_at TIMESTAMP WITH TIME ZONE,
+    finished_at TIMESTAMP WITH TIME ZONE,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX processing_jobs_product_idx ON processing_jobs (product_id);
+
+CREATE TABLE outbox (
+    id BIGSERIAL PRIMARY KEY,
+    job_id BIGINT,
+    message_id VARCHAR(64),
+    queue VARCHAR(255) NOT NULL,
+    payload JSONB NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT,
+    next_attempt_at TIMESTAMP WITH TIME ZONE,
+    failed_at TIMESTAMP WITH TIME ZONE,
+    locked_until TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    sent_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX outbox_unsent_idx ON outbox (id) WHERE sent_at IS NULL;
\ No newline at end of file
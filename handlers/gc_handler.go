@@ -0,0 +1,20 @@
+package handlers
+
+import (
+	"AsyncProd/config"
+	"AsyncProd/services"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// runs the orphaned object collector in dry run mode and returns what it
+// would delete. Deleting is left to the scheduled collector.
+func GetOrphanedObjectsHandler(c *gin.Context) {
+	report, err := services.CollectOrphanedObjects(true, config.GCGracePeriod)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,243 @@
+package handlers
+
+import (
+	"AsyncProd/config"
+	"AsyncProd/models"
+	"AsyncProd/pkg/image"
+	"AsyncProd/services"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// accepts multipart image uploads for a product
+func UploadProductImagesHandler(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid product ID"})
+		return
+	}
+
+	if _, err := models.GetProductByID(id); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	// room for every file plus the multipart framing
+	maxBody := config.UploadMaxBytes*int64(config.UploadMaxFiles) + 1<<20
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxBody)
+
+	form, err := c.MultipartForm()
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Upload is too large"})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid multipart form"})
+		return
+	}
+
+	files := form.File["images"]
+	if len(files) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No images uploaded, use the \"images\" field"})
+		return
+	}
+	if len(files) > config.UploadMaxFiles {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("At most %d images can be uploaded at once", config.UploadMaxFiles)})
+		return
+	}
+
+	// validate everything before storing anything
+	type upload struct {
+		data   []byte
+		format string
+	}
+	uploads := make([]upload, 0, len(files))
+	for _, fh := range files {
+		data, format, status, err := readUploadedImage(fh)
+		if err != nil {
+			c.JSON(status, gin.H{"error": err.Error()})
+			return
+		}
+		uploads = append(uploads, upload{data: data, format: format})
+	}
+
+	var imageURLs []string
+	for _, u := range uploads {
+		imageURL, err := services.StoreOriginalImage(c.Request.Context(), id, u.data, u.format)
+		if err != nil {
+			log.Printf("ERROR: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store image"})
+			return
+		}
+		imageURLs = append(imageURLs, imageURL)
+	}
+
+	appendAndQueueImages(c, id, imageURLs)
+}
+
+type presignRequest struct {
+	Files []struct {
+		ContentType string `json:"content_type" binding:"required"`
+	} `json:"files" binding:"required"`
+}
+
+// hands out presigned S3 PUT URLs so browsers upload originals directly
+func PresignProductUploadsHandler(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid product ID"})
+		return
+	}
+
+	var req presignRequest
+	if err := c.ShouldBindJSON(&req); err != nil || len(req.Files) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	if len(req.Files) > config.UploadMaxFiles {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("At most %d images can be uploaded at once", config.UploadMaxFiles)})
+		return
+	}
+
+	if _, err := models.GetProductByID(id); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	uploads := make([]*services.PresignedUpload, 0, len(req.Files))
+	for _, f := range req.Files {
+		upload, err := services.PresignOriginalUpload(id, f.ContentType)
+		if err != nil {
+			if errors.Is(err, services.ErrUploadInvalid) {
+				c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": err.Error()})
+				return
+			}
+			if errors.Is(err, services.ErrUploadUnsupported) {
+				c.JSON(http.StatusNotImplemented, gin.H{"error": err.Error()})
+				return
+			}
+			log.Printf("ERROR: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create upload URL"})
+			return
+		}
+		uploads = append(uploads, upload)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"uploads":   uploads,
+		"max_bytes": config.UploadMaxBytes,
+	})
+}
+
+type confirmRequest struct {
+	Keys []string `json:"keys" binding:"required"`
+}
+
+// called after presigned uploads finished, verifies them and queues compression
+func ConfirmProductUploadsHandler(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid product ID"})
+		return
+	}
+
+	var req confirmRequest
+	if err := c.ShouldBindJSON(&req); err != nil || len(req.Keys) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	product, err := models.GetProductByID(id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	existing := make(map[string]bool, len(product.ProductImages))
+	for _, img := range product.ProductImages {
+		existing[img] = true
+	}
+
+	var imageURLs []string
+	for _, key := range req.Keys {
+		imageURL, err := services.ConfirmOriginalUpload(c.Request.Context(), id, key)
+		if err != nil {
+			switch {
+			case errors.Is(err, services.ErrUploadNotFound):
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			case errors.Is(err, services.ErrUploadInvalid):
+				c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+			default:
+				log.Printf("ERROR: %v", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify upload"})
+			}
+			return
+		}
+		// confirming twice must not add the image twice
+		if !existing[imageURL] {
+			existing[imageURL] = true
+			imageURLs = append(imageURLs, imageURL)
+		}
+	}
+
+	if len(imageURLs) == 0 {
+		c.JSON(http.StatusOK, gin.H{"product_id": id, "product_images": product.ProductImages})
+		return
+	}
+	appendAndQueueImages(c, id, imageURLs)
+}
+
+// adds new originals to the product and queues the product for compression
+func appendAndQueueImages(c *gin.Context, id int, imageURLs []string) {
+	// the worker rebuilds the compressed set from all of the product's images,
+	// the job is queued through the outbox with the new image list
+	_, productImages, err := models.AppendProductImages(id, imageURLs, services.ImageProcessingOutbox)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	log.Printf("SUCCESS: Queued image processing for product ID: %d", id)
+
+	c.JSON(http.StatusCreated, gin.H{
+		"product_id":     id,
+		"uploaded":       imageURLs,
+		"product_images": productImages,
+	})
+}
+
+// reads one uploaded file and checks its size and content type,
+// returns the HTTP status to answer with on error
+func readUploadedImage(fh *multipart.FileHeader) ([]byte, string, int, error) {
+	if fh.Size > config.UploadMaxBytes {
+		return nil, "", http.StatusRequestEntityTooLarge, fmt.Errorf("%s is larger than %d bytes", fh.Filename, config.UploadMaxBytes)
+	}
+
+	f, err := fh.Open()
+	if err != nil {
+		return nil, "", http.StatusBadRequest, fmt.Errorf("failed to read %s", fh.Filename)
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(io.LimitReader(f, config.UploadMaxBytes+1))
+	if err != nil {
+		return nil, "", http.StatusBadRequest, fmt.Errorf("failed to read %s", fh.Filename)
+	}
+	if int64(len(data)) > config.UploadMaxBytes {
+		return nil, "", http.StatusRequestEntityTooLarge, fmt.Errorf("%s is larger than %d bytes", fh.Filename, config.UploadMaxBytes)
+	}
+
+	// trust the bytes, not the client supplied Content-Type
+	format := image.DetectFormat(data)
+	if format == "" {
+		return nil, "", http.StatusUnsupportedMediaType, fmt.Errorf("%s is not a supported image", fh.Filename)
+	}
+
+	return data, format, http.StatusOK, nil
+}
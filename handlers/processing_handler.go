@@ -0,0 +1,42 @@
+package handlers
+
+import (
+	"AsyncProd/models"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// returns the product's image processing jobs, newest first, with the
+// per-image results of each
+func GetProductProcessingHandler(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid product ID"})
+		return
+	}
+
+	if _, err := models.GetProductByID(id); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	jobs, err := models.GetProcessingJobs(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// the latest job decides what the product's images look like
+	status := ""
+	if len(jobs) > 0 {
+		status = jobs[0].Status
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"product_id": id,
+		"status":     status,
+		"jobs":       jobs,
+	})
+}
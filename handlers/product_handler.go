@@ -18,19 +18,14 @@ func CreateProductHandler(c *gin.Context) {
         return
     }
 
-    productID, err := models.SaveProduct(&product)
+    // the image processing job is written to the outbox with the product,
+    // the outbox relay publishes it
+    productID, err := models.SaveProduct(&product, services.ImageProcessingOutbox)
     if err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save product"})
         return
     }
-
-    // publish message for image processing
-    err = services.PublishImageProcessingMessage(productID, product.UserID, product.ProductImages)
-    if err != nil {
-        log.Printf("ERROR: Failed to publish image processing message: %v", err)
-    } else {
-        log.Printf("SUCCESS: Published image processing message for product ID: %d", productID)
-    }
+    log.Printf("SUCCESS: Queued image processing for product ID: %d", productID)
 
     c.JSON(http.StatusCreated, gin.H{"product_id": productID})
 }
@@ -50,6 +45,7 @@ func GetProductByIDHandler(c *gin.Context) {
         return
     }
 
+    services.PresentProduct(c.Request.Context(), product)
     c.JSON(http.StatusOK, product)
 }
 
@@ -61,18 +57,12 @@ func UpdateProductHandler(c *gin.Context) {
         return
     }
 
-    if err := models.UpdateProduct(&product); err != nil {
+    // queues image processing through the outbox in the same transaction
+    if err := models.UpdateProduct(&product, services.ImageProcessingOutbox); err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
         return
     }
-
-    // Publish message for image processing
-    err := services.PublishImageProcessingMessage(product.ID, product.UserID, product.ProductImages)
-    if err != nil {
-        log.Printf("ERROR: Failed to publish image processing message: %v", err)
-    } else {
-        log.Printf("SUCCESS: Published image processing message for product ID: %d", product.ID)
-    }
+    log.Printf("SUCCESS: Queued image processing for product ID: %d", product.ID)
 
     c.JSON(http.StatusOK, gin.H{"message": "Product updated successfully"})
 }
@@ -98,5 +88,9 @@ func GetProductsByUserHandler(c *gin.Context) {
         return
     }
 
+    for i := range products {
+        services.PresentProduct(c.Request.Context(), &products[i])
+    }
+
     c.JSON(http.StatusOK, products)
 }
@@ -3,6 +3,7 @@ package main
 import (
 	"AsyncProd/config"
 	"AsyncProd/handlers"
+	"AsyncProd/pkg/blobstore"
 	"AsyncProd/services"
 	"context"
 	"log"
@@ -26,7 +27,13 @@ func main() {
 	defer config.CloseRedis()
 	config.InitRabbitMQ()
 	defer config.CloseRabbitMQ()
+	services.StartPublisher()
 	config.InitS3()
+	config.InitStorage()
+	config.InitImage()
+	services.RegisterImageSources()
+	config.InitGC()
+	config.InitOutbox()
 
 	// Start the image processing service in the background.
 	go func() {
@@ -34,6 +41,12 @@ func main() {
 		services.ProcessImageFromQueue()
 	}()
 
+	// Publish image jobs written to the outbox.
+	go services.StartOutboxRelay()
+
+	// Collect S3 objects no product references anymore, if enabled.
+	go services.StartGarbageCollector()
+
 	
 	r := gin.New()
 
@@ -62,9 +75,22 @@ func main() {
 		v1.GET("/products/:id", handlers.GetProductByIDHandler)
 		v1.GET("/products", handlers.GetProductsByUserHandler)
 		v1.PUT("/products", handlers.UpdateProductHandler)
+		v1.POST("/products/:id/images", handlers.UploadProductImagesHandler)
+		v1.POST("/products/:id/uploads", handlers.PresignProductUploadsHandler)
+		v1.POST("/products/:id/uploads/confirm", handlers.ConfirmProductUploadsHandler)
+		v1.GET("/products/:id/processing", handlers.GetProductProcessingHandler)
+		v1.GET("/admin/gc", handlers.GetOrphanedObjectsHandler)
 	}
 
 	
+	// the local and memory storage backends are served by the API itself
+	switch store := config.Blob.(type) {
+	case *blobstore.LocalStore:
+		r.Static(config.BlobRoute, store.Root())
+	case *blobstore.MemoryStore:
+		r.GET(config.BlobRoute+"/*key", gin.WrapH(http.StripPrefix(config.BlobRoute, store)))
+	}
+
 	r.GET("/health", healthCheckHandler)
 	r.GET("/redis-health", redisHealthCheckHandler)
 
@@ -110,9 +136,14 @@ func healthCheckHandler(c *gin.Context) {
 		})
 		return
 	}
+	rabbitMQ := "connected"
+	if !config.RabbitMQConnected() {
+		rabbitMQ = "reconnecting"
+	}
 	c.JSON(http.StatusOK, gin.H{
 		"status":   "healthy",
 		"database": "connected",
+		"rabbitmq": rabbitMQ,
 	})
 }
 
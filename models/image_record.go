@@ -0,0 +1,77 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+)
+
+// states of a single source image
+const (
+	ImageSucceeded = "succeeded"
+	// some renditions were stored, others failed to upload
+	ImagePartial = "partial"
+	ImageFailed  = "failed"
+)
+
+// outcome of processing a single source image
+type ImageRecord struct {
+	SourceURL       string        `json:"source_url"`
+	Status          string        `json:"status"`
+	SourceFormat    string        `json:"source_format,omitempty"`
+	SourceWidth     int           `json:"source_width,omitempty"`
+	SourceHeight    int           `json:"source_height,omitempty"`
+	SourceBytes     int           `json:"source_bytes,omitempty"`
+	Outputs         []ImageOutput `json:"outputs,omitempty"`
+	Error           string        `json:"error,omitempty"`
+	ErrorReason     string        `json:"error_reason,omitempty"`
+	MetadataRemoved []string      `json:"metadata_removed,omitempty"`
+	MetadataKept    []string      `json:"metadata_kept,omitempty"`
+}
+
+// one stored rendition of a source image
+type ImageOutput struct {
+	Rendition string `json:"rendition"`
+	Key       string `json:"key"`
+	Format    string `json:"format"`
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+	Bytes     int    `json:"bytes"`
+}
+
+// per-image records in the same order as ProductImages, stored as JSONB
+type ImageRecords []ImageRecord
+
+func (r ImageRecords) Value() (driver.Value, error) {
+	if r == nil {
+		return "[]", nil
+	}
+	return jsonValue(r)
+}
+
+func (r *ImageRecords) Scan(src interface{}) error {
+	return scanJSON(src, r)
+}
+
+// encodes v as JSON text for a JSONB column
+func jsonValue(v interface{}) (driver.Value, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// decodes a JSONB column into dst, NULL leaves dst untouched
+func scanJSON(src interface{}, dst interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		return nil
+	case []byte:
+		return json.Unmarshal(v, dst)
+	case string:
+		return json.Unmarshal([]byte(v), dst)
+	default:
+		return fmt.Errorf("cannot scan %T into %T", src, dst)
+	}
+}
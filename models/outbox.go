@@ -0,0 +1,246 @@
+package models
+
+import (
+	"AsyncProd/config"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// OutboxMessage is a message written in the same transaction as the
+// product change it belongs to, the relay publishes it afterwards.
+type OutboxMessage struct {
+	ID    int64
+	JobID int64
+	// MessageID is published as the AMQP message ID, the worker uses it
+	// to tell redeliveries apart from new jobs
+	MessageID string
+	Queue     string
+	Payload   []byte
+	Attempts  int
+	CreatedAt time.Time
+}
+
+// builds the message for a product once it's written, the product has
+// its ID, owner and images set and job is the processing job it starts
+type OutboxBuilder func(product *Product, job *ProcessingJob) (*OutboxMessage, error)
+
+func insertOutboxMessage(tx *sql.Tx, product *Product, outbox OutboxBuilder) error {
+	if outbox == nil {
+		return nil
+	}
+	job, err := createProcessingJob(tx, product.ID)
+	if err != nil {
+		return err
+	}
+	msg, err := outbox(product, job)
+	if err != nil {
+		return fmt.Errorf("failed to build outbox message: %v", err)
+	}
+	_, err = tx.Exec(
+		`INSERT INTO outbox (job_id, message_id, queue, payload, created_at) VALUES ($1, $2, $3, $4, NOW())`,
+		job.ID,
+		msg.MessageID,
+		msg.Queue,
+		string(msg.Payload),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to write outbox message: %v", err)
+	}
+	return nil
+}
+
+// ErrOutboxUnavailable is wrapped by publish errors that aren't the
+// message's fault, like a lost broker connection. They end the batch
+// without counting an attempt.
+var ErrOutboxUnavailable = errors.New("outbox publishing unavailable")
+
+// claims up to limit unsent messages that are due, oldest first, and
+// hands them to publish one by one. Claiming sets locked_until in a short
+// transaction, so no row lock or connection is held while publishing, and
+// other relays skip the rows until the lease runs out. Each result is
+// recorded in its own transaction. A failed message is put back with
+// backoff and the batch goes on, after config.OutboxMaxAttempts it's given
+// up and its job is dead. Returns how many messages were sent and how many
+// failed.
+func RelayOutbox(limit int, publish func(msg OutboxMessage) error) (int, int, error) {
+	messages, err := claimOutboxMessages(limit)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	sent, failed := 0, 0
+	for i, msg := range messages {
+		publishErr := publish(msg)
+		if errors.Is(publishErr, ErrOutboxUnavailable) {
+			// the rest goes to the next poll without waiting for the lease
+			if err := releaseOutboxMessages(messages[i:]); err != nil {
+				log.Printf("WARNING: %v", err)
+			}
+			return sent, failed, fmt.Errorf("failed to publish outbox message: %w", publishErr)
+		}
+		if publishErr != nil {
+			err = inTx(func(tx *sql.Tx) error { return recordOutboxFailure(tx, msg, publishErr) })
+			if err != nil {
+				return sent, failed, err
+			}
+			failed++
+			continue
+		}
+		err = inTx(func(tx *sql.Tx) error { return markOutboxMessageSent(tx, msg) })
+		if err != nil {
+			return sent, failed, err
+		}
+		sent++
+	}
+	return sent, failed, nil
+}
+
+// sets the lease on the next due messages and returns them, the lease
+// covers waiting for the confirm of every message in the batch
+func claimOutboxMessages(limit int) ([]OutboxMessage, error) {
+	lease := time.Duration(limit)*config.PublishConfirmTimeout + time.Minute
+	rows, err := config.DB.Query(`
+		UPDATE outbox
+		SET locked_until = NOW() + $2::double precision * INTERVAL '1 second'
+		WHERE id IN (
+			SELECT id
+			FROM outbox
+			WHERE sent_at IS NULL
+				AND failed_at IS NULL
+				AND (next_attempt_at IS NULL OR next_attempt_at <= NOW())
+				AND (locked_until IS NULL OR locked_until <= NOW())
+			ORDER BY id
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, COALESCE(job_id, 0), COALESCE(message_id, 'outbox-' || id), queue, payload, attempts, created_at
+	`, limit, lease.Seconds())
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim outbox messages: %v", err)
+	}
+	defer rows.Close()
+
+	var messages []OutboxMessage
+	for rows.Next() {
+		var msg OutboxMessage
+		err := rows.Scan(&msg.ID, &msg.JobID, &msg.MessageID, &msg.Queue, &msg.Payload, &msg.Attempts, &msg.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning outbox message: %v", err)
+		}
+		messages = append(messages, msg)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error during outbox retrieval: %v", err)
+	}
+
+	// RETURNING has no order
+	sort.Slice(messages, func(i, j int) bool { return messages[i].ID < messages[j].ID })
+	return messages, nil
+}
+
+// gives up the lease of messages that weren't tried
+func releaseOutboxMessages(messages []OutboxMessage) error {
+	ids := make([]int64, len(messages))
+	for i, msg := range messages {
+		ids[i] = msg.ID
+	}
+	_, err := config.DB.Exec(`UPDATE outbox SET locked_until = NULL WHERE id = ANY($1)`, pq.Array(ids))
+	if err != nil {
+		return fmt.Errorf("failed to release outbox messages: %v", err)
+	}
+	return nil
+}
+
+func markOutboxMessageSent(tx *sql.Tx, msg OutboxMessage) error {
+	_, err := tx.Exec(`UPDATE outbox SET sent_at = NOW(), attempts = attempts + 1, locked_until = NULL WHERE id = $1`, msg.ID)
+	if err != nil {
+		return fmt.Errorf("failed to mark outbox message sent: %v", err)
+	}
+	_, err = tx.Exec(`UPDATE processing_jobs SET published_at = NOW(), updated_at = NOW() WHERE id = $1`, msg.JobID)
+	if err != nil {
+		return fmt.Errorf("failed to mark processing job published: %v", err)
+	}
+	return nil
+}
+
+func inTx(fn func(tx *sql.Tx) error) error {
+	tx, err := config.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit outbox: %v", err)
+	}
+	return nil
+}
+
+// schedules the next attempt of a failed message, or gives it up and
+// marks its job dead once it's out of attempts
+func recordOutboxFailure(tx *sql.Tx, msg OutboxMessage, publishErr error) error {
+	attempts := msg.Attempts + 1
+	lastError := "failed to publish: " + publishErr.Error()
+
+	if attempts >= config.OutboxMaxAttempts {
+		log.Printf("ERROR: Giving up on outbox message %d after %d attempts: %v", msg.ID, attempts, publishErr)
+		_, err := tx.Exec(
+			`UPDATE outbox SET attempts = $2, last_error = $3, failed_at = NOW(), locked_until = NULL WHERE id = $1`,
+			msg.ID,
+			attempts,
+			publishErr.Error(),
+		)
+		if err != nil {
+			return fmt.Errorf("failed to record outbox failure: %v", err)
+		}
+		_, err = tx.Exec(`
+			UPDATE processing_jobs
+			SET status = $2, last_error = $3, finished_at = NOW(), updated_at = NOW()
+			WHERE id = $1
+		`, msg.JobID, JobDead, lastError)
+		if err != nil {
+			return fmt.Errorf("failed to record outbox failure: %v", err)
+		}
+		return nil
+	}
+
+	delay := config.OutboxRetryDelay(attempts)
+	log.Printf("WARNING: Failed to publish outbox message %d, retrying in %s: %v", msg.ID, delay, publishErr)
+	_, err := tx.Exec(
+		`UPDATE outbox SET attempts = $2, last_error = $3, next_attempt_at = $4, locked_until = NULL WHERE id = $1`,
+		msg.ID,
+		attempts,
+		publishErr.Error(),
+		time.Now().Add(delay),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to record outbox failure: %v", err)
+	}
+	_, err = tx.Exec(
+		`UPDATE processing_jobs SET last_error = $2, updated_at = NOW() WHERE id = $1`,
+		msg.JobID,
+		lastError,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to record outbox failure: %v", err)
+	}
+	return nil
+}
+
+// removes sent messages older than the cutoff
+func DeleteSentOutboxMessages(olderThan time.Time) (int64, error) {
+	result, err := config.DB.Exec(`DELETE FROM outbox WHERE sent_at < $1`, olderThan)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete sent outbox messages: %v", err)
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,157 @@
+package models
+
+import (
+	"AsyncProd/config"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// states of an image processing job
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobRetrying  = "retrying"
+	JobSucceeded = "succeeded"
+	JobPartial   = "partial"
+	JobFailed    = "failed"
+	JobDead      = "dead"
+)
+
+// ProcessingJob tracks one image processing run of a product, from the
+// write that queued it to its final state.
+type ProcessingJob struct {
+	ID           int64        `json:"id"`
+	ProductID    int          `json:"product_id"`
+	Status       string       `json:"status"`
+	Attempts     int          `json:"attempts"`
+	LastError    *string      `json:"last_error,omitempty"`
+	ImageRecords ImageRecords `json:"image_records,omitempty"`
+	CreatedAt    time.Time    `json:"created_at"`
+	PublishedAt  *time.Time   `json:"published_at,omitempty"`
+	StartedAt    *time.Time   `json:"started_at,omitempty"`
+	FinishedAt   *time.Time   `json:"finished_at,omitempty"`
+	UpdatedAt    time.Time    `json:"updated_at"`
+}
+
+func createProcessingJob(tx *sql.Tx, productID int) (*ProcessingJob, error) {
+	job := ProcessingJob{ProductID: productID, Status: JobQueued}
+	err := tx.QueryRow(`
+		INSERT INTO processing_jobs (product_id, status, created_at, updated_at)
+		VALUES ($1, $2, NOW(), NOW())
+		RETURNING id, created_at, updated_at
+	`, productID, JobQueued).Scan(&job.ID, &job.CreatedAt, &job.UpdatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create processing job: %v", err)
+	}
+	return &job, nil
+}
+
+// marks the job as picked up by a worker for the given attempt
+func StartProcessingJob(id int64, attempt int) error {
+	_, err := config.DB.Exec(`
+		UPDATE processing_jobs
+		SET status = $2, attempts = $3, started_at = COALESCE(started_at, NOW()), updated_at = NOW()
+		WHERE id = $1
+	`, id, JobRunning, attempt)
+	if err != nil {
+		return fmt.Errorf("failed to start processing job: %v", err)
+	}
+	return nil
+}
+
+// records a failed attempt that will be tried again, records are kept
+// when not nil
+func RetryProcessingJob(id int64, records ImageRecords, lastError string) error {
+	_, err := config.DB.Exec(`
+		UPDATE processing_jobs
+		SET status = $2, image_records = COALESCE($3, image_records), last_error = $4, updated_at = NOW()
+		WHERE id = $1
+	`, id, JobRetrying, nullableRecords(records), lastError)
+	if err != nil {
+		return fmt.Errorf("failed to update processing job: %v", err)
+	}
+	return nil
+}
+
+// moves the job to a final state, records are kept when not nil
+func FinishProcessingJob(id int64, status string, records ImageRecords, lastError string) error {
+	var errValue interface{}
+	if lastError != "" {
+		errValue = lastError
+	}
+	_, err := config.DB.Exec(`
+		UPDATE processing_jobs
+		SET
+			status = $2,
+			image_records = COALESCE($3, image_records),
+			last_error = COALESCE($4, last_error),
+			finished_at = NOW(),
+			updated_at = NOW()
+		WHERE id = $1
+	`, id, status, nullableRecords(records), errValue)
+	if err != nil {
+		return fmt.Errorf("failed to finish processing job: %v", err)
+	}
+	return nil
+}
+
+// every job of the product, newest first
+func GetProcessingJobs(productID int) ([]ProcessingJob, error) {
+	rows, err := config.DB.Query(`
+		SELECT
+			id,
+			product_id,
+			status,
+			attempts,
+			last_error,
+			image_records,
+			created_at,
+			published_at,
+			started_at,
+			finished_at,
+			updated_at
+		FROM processing_jobs
+		WHERE product_id = $1
+		ORDER BY id DESC
+	`, productID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve processing jobs: %v", err)
+	}
+	defer rows.Close()
+
+	jobs := []ProcessingJob{}
+	for rows.Next() {
+		var job ProcessingJob
+		err := rows.Scan(
+			&job.ID,
+			&job.ProductID,
+			&job.Status,
+			&job.Attempts,
+			&job.LastError,
+			&job.ImageRecords,
+			&job.CreatedAt,
+			&job.PublishedAt,
+			&job.StartedAt,
+			&job.FinishedAt,
+			&job.UpdatedAt,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning processing job: %v", err)
+		}
+		jobs = append(jobs, job)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error during processing job retrieval: %v", err)
+	}
+	return jobs, nil
+}
+
+// NULL for the COALESCEs above when there are no records
+func nullableRecords(records ImageRecords) interface{} {
+	if records == nil {
+		return nil
+	}
+	return records
+}
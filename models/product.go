@@ -3,6 +3,7 @@ package models
 import (
 	"AsyncProd/config"
 	"database/sql"
+	"database/sql/driver"
 	"errors"
 	"fmt"
 	"log"
@@ -11,17 +12,35 @@ import (
 	"github.com/lib/pq"
 )
 
+// ErrJobSuperseded is returned for results of a job older than the one
+// already applied to the product.
+var ErrJobSuperseded = errors.New("a newer processing job already updated the product")
 
 type Product struct {
-	ID                  int       `json:"id"`
-	UserID              int       `json:"user_id"`
-	ProductName         string    `json:"product_name"`
-	ProductDescription  string    `json:"product_description"`
-	ProductImages       []string  `json:"product_images"`
-	ProductPrice        float64   `json:"product_price"`
-	CompressedImages    []string  `json:"compressed_product_images,omitempty"`
-	CreatedAt           time.Time `json:"created_at,omitempty"`
-	UpdatedAt           time.Time `json:"updated_at,omitempty"`
+	ID                  int           `json:"id"`
+	UserID              int           `json:"user_id"`
+	ProductName         string        `json:"product_name"`
+	ProductDescription  string        `json:"product_description"`
+	ProductImages       []string      `json:"product_images"`
+	ProductPrice        float64       `json:"product_price"`
+	CompressedImages    RenditionURLs `json:"compressed_product_images,omitempty"`
+	ImageRecords        ImageRecords  `json:"image_records,omitempty"`
+	CreatedAt           time.Time     `json:"created_at,omitempty"`
+	UpdatedAt           time.Time     `json:"updated_at,omitempty"`
+}
+
+// compressed image URLs grouped by rendition name, stored as JSONB
+type RenditionURLs map[string][]string
+
+func (r RenditionURLs) Value() (driver.Value, error) {
+	if r == nil {
+		return "{}", nil
+	}
+	return jsonValue(r)
+}
+
+func (r *RenditionURLs) Scan(src interface{}) error {
+	return scanJSON(src, r)
 }
 
 func (p *Product) Validate() error {
@@ -38,12 +57,19 @@ func (p *Product) Validate() error {
 }
 
 
-func SaveProduct(product *Product) (int, error) {
+// inserts the product, and the outbox message when outbox is set, in one transaction
+func SaveProduct(product *Product, outbox OutboxBuilder) (int, error) {
 
     if err := product.Validate(); err != nil {
         return 0, err
     }
 
+    tx, err := config.DB.Begin()
+    if err != nil {
+        return 0, fmt.Errorf("failed to begin transaction: %v", err)
+    }
+    defer tx.Rollback()
+
     query := `
         INSERT INTO products (
             user_id, 
@@ -57,7 +83,7 @@ func SaveProduct(product *Product) (int, error) {
         RETURNING id
     `
     var productID int
-    err := config.DB.QueryRow(
+    err = tx.QueryRow(
         query, 
         product.UserID, 
         product.ProductName, 
@@ -72,13 +98,20 @@ func SaveProduct(product *Product) (int, error) {
         return 0, fmt.Errorf("failed to save product: %v", err)
     }
 
+    product.ID = productID
+    if err := insertOutboxMessage(tx, product, outbox); err != nil {
+        return 0, err
+    }
+    if err := tx.Commit(); err != nil {
+        return 0, fmt.Errorf("failed to save product: %v", err)
+    }
+
     return productID, nil
 }
 
 func GetProductByID(id int) (*Product, error) {
 	var product Product
 	var images pq.StringArray
-	var compressedImages pq.StringArray
 
 	query := `
 		SELECT 
@@ -89,6 +122,7 @@ func GetProductByID(id int) (*Product, error) {
 			product_price, 
 			product_images, 
 			compressed_product_images,
+			image_records,
 			created_at,
 			updated_at
 		FROM products
@@ -101,7 +135,8 @@ func GetProductByID(id int) (*Product, error) {
 		&product.ProductDescription,
 		&product.ProductPrice, 
 		&images, 
-		&compressedImages,
+		&product.CompressedImages,
+		&product.ImageRecords,
 		&product.CreatedAt,
 		&product.UpdatedAt,
 	)
@@ -114,16 +149,22 @@ func GetProductByID(id int) (*Product, error) {
 	}
 
 	product.ProductImages = images
-	product.CompressedImages = compressedImages
 	return &product, nil
 }
 
 
-func UpdateProduct(product *Product) error {
+// updates the product, and writes the outbox message when outbox is set, in one transaction
+func UpdateProduct(product *Product, outbox OutboxBuilder) error {
 	if err := product.Validate(); err != nil {
 		return err
 	}
 
+	tx, err := config.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
 	query := `
 		UPDATE products
 		SET 
@@ -131,18 +172,16 @@ func UpdateProduct(product *Product) error {
 			product_description = $3, 
 			product_price = $4, 
 			product_images = $5,
-			compressed_product_images = $6,
 			updated_at = NOW()
-		WHERE id = $1 AND user_id = $7
+		WHERE id = $1 AND user_id = $6
 	`
-	result, err := config.DB.Exec(
+	result, err := tx.Exec(
 		query,
 		product.ID,
 		product.ProductName,
 		product.ProductDescription,
 		product.ProductPrice,
 		pq.Array(product.ProductImages),
-		pq.Array(product.CompressedImages),
 		product.UserID,
 	)
 
@@ -159,9 +198,93 @@ func UpdateProduct(product *Product) error {
 		return errors.New("no product found or unauthorized to update")
 	}
 
+	if err := insertOutboxMessage(tx, product, outbox); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to update product: %v", err)
+	}
+
 	return nil
 }
 
+// appends images to a product and returns its owner and full image list,
+// the outbox message is written in the same transaction when outbox is set
+func AppendProductImages(productID int, images []string, outbox OutboxBuilder) (int, []string, error) {
+	tx, err := config.DB.Begin()
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	query := `
+		UPDATE products
+		SET
+			product_images = array_cat(COALESCE(product_images, '{}'), $2::text[]),
+			updated_at = NOW()
+		WHERE id = $1
+		RETURNING user_id, product_images
+	`
+	var userID int
+	var allImages pq.StringArray
+	err = tx.QueryRow(query, productID, pq.Array(images)).Scan(&userID, &allImages)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, nil, errors.New("product not found")
+		}
+		return 0, nil, fmt.Errorf("failed to append product images: %v", err)
+	}
+
+	product := &Product{ID: productID, UserID: userID, ProductImages: allImages}
+	if err := insertOutboxMessage(tx, product, outbox); err != nil {
+		return 0, nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, nil, fmt.Errorf("failed to append product images: %v", err)
+	}
+
+	return userID, allImages, nil
+}
+
+// stores the worker's results, only the columns the worker owns are written
+// so images appended meanwhile aren't lost. Job IDs grow with every write,
+// results of an older job than the one applied last are refused with
+// ErrJobSuperseded. Messages from before jobs existed have job ID 0 and
+// always apply.
+func SetProcessedImages(productID int, jobID int64, compressedImages RenditionURLs, records ImageRecords) error {
+	query := `
+		UPDATE products
+		SET
+			compressed_product_images = $3,
+			image_records = $4,
+			last_job_id = GREATEST(last_job_id, NULLIF($2::bigint, 0)),
+			updated_at = NOW()
+		WHERE id = $1 AND ($2 = 0 OR last_job_id IS NULL OR last_job_id <= $2)
+	`
+	result, err := config.DB.Exec(query, productID, jobID, compressedImages, records)
+	if err != nil {
+		return fmt.Errorf("failed to update processed images: %v", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error checking update result: %v", err)
+	}
+	if rowsAffected > 0 {
+		return nil
+	}
+
+	var exists bool
+	err = config.DB.QueryRow(`SELECT EXISTS (SELECT 1 FROM products WHERE id = $1)`, productID).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("error checking update result: %v", err)
+	}
+	if !exists {
+		return errors.New("product not found")
+	}
+	return ErrJobSuperseded
+}
+
 func GetProductsByUserID(userID int, minPrice, maxPrice float64, productName string) ([]Product, error) {
 	query := `
 		SELECT 
@@ -172,6 +295,7 @@ func GetProductsByUserID(userID int, minPrice, maxPrice float64, productName str
 			product_price, 
 			product_images, 
 			compressed_product_images,
+			image_records,
 			created_at,
 			updated_at
 		FROM products
@@ -190,7 +314,7 @@ func GetProductsByUserID(userID int, minPrice, maxPrice float64, productName str
 	var products []Product
 	for rows.Next() {
 		var product Product
-		var images, compressedImages pq.StringArray
+		var images pq.StringArray
 		
 		err := rows.Scan(
 			&product.ID, 
@@ -199,7 +323,8 @@ func GetProductsByUserID(userID int, minPrice, maxPrice float64, productName str
 			&product.ProductDescription,
 			&product.ProductPrice, 
 			&images, 
-			&compressedImages,
+			&product.CompressedImages,
+			&product.ImageRecords,
 			&product.CreatedAt,
 			&product.UpdatedAt,
 		)
@@ -208,7 +333,6 @@ func GetProductsByUserID(userID int, minPrice, maxPrice float64, productName str
 		}
 
 		product.ProductImages = images
-		product.CompressedImages = compressedImages
 		products = append(products, product)
 	}
 
@@ -218,3 +342,31 @@ func GetProductsByUserID(userID int, minPrice, maxPrice float64, productName str
 
 	return products, nil
 }
+
+// every original and compressed image URL referenced by any product
+func GetReferencedImageURLs() ([]string, error) {
+	rows, err := config.DB.Query(`SELECT product_images, compressed_product_images FROM products`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve image references: %v", err)
+	}
+	defer rows.Close()
+
+	var urls []string
+	for rows.Next() {
+		var images pq.StringArray
+		var compressed RenditionURLs
+		if err := rows.Scan(&images, &compressed); err != nil {
+			return nil, fmt.Errorf("error scanning image references: %v", err)
+		}
+		urls = append(urls, images...)
+		for _, renditionURLs := range compressed {
+			urls = append(urls, renditionURLs...)
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error during image reference retrieval: %v", err)
+	}
+
+	return urls, nil
+}
@@ -0,0 +1,66 @@
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+var ErrNotFound = errors.New("object not found")
+
+// ObjectInfo describes a stored object.
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	ContentType  string
+	CacheControl string
+	Metadata     map[string]string
+	LastModified time.Time
+}
+
+// PutOptions carries the attributes stored alongside an object. Stores
+// that have no notion of a field ignore it.
+type PutOptions struct {
+	ContentType  string
+	CacheControl string
+	// StorageClass is passed through to S3, empty uses the bucket default
+	StorageClass string
+	// Metadata is user defined, keys should be lowercase with dashes
+	Metadata map[string]string
+}
+
+// BlobStore is the storage the image pipeline reads originals from
+// and writes renditions to.
+type BlobStore interface {
+	Put(ctx context.Context, key string, data []byte, opts PutOptions) error
+	// Get returns the object body, the caller has to close it
+	Get(ctx context.Context, key string) (io.ReadCloser, *ObjectInfo, error)
+	Head(ctx context.Context, key string) (*ObjectInfo, error)
+	Delete(ctx context.Context, key string) error
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+	// URL is the address clients fetch the object from
+	URL(key string) string
+}
+
+// Presigner is implemented by stores that can hand out short-lived URLs
+// clients upload to or download from directly.
+type Presigner interface {
+	PresignPut(key, contentType string, expiry time.Duration) (string, error)
+	PresignGet(key string, expiry time.Duration) (string, error)
+}
+
+// keys are relative slash separated paths without . or .. segments
+func validateKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") {
+		return fmt.Errorf("invalid key %q", key)
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return fmt.Errorf("invalid key %q", key)
+		}
+	}
+	return nil
+}
@@ -2,50 +2,155 @@ package image
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"image"
+	_ "image/gif"
 	"image/jpeg"
 	"image/png"
-	"io"
 	"log"
-	"net/http"
-	"path/filepath"
-	"strings"
 
+	_ "golang.org/x/image/bmp"
 	"golang.org/x/image/draw"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
 )
 
-const (
-	maxWidth  = 800
-	maxHeight = 600
-	quality   = 75
-)
+// UnsupportedFormatError is returned when an image is in a format
+// that can't be decoded or a rendition asks for one that can't be encoded.
+type UnsupportedFormatError struct {
+	Format string
+}
 
+func (e *UnsupportedFormatError) Error() string {
+	if e.Format == "" {
+		return "unsupported image format: unrecognised content"
+	}
+	return fmt.Sprintf("unsupported image format: %s", e.Format)
+}
 
-func CompressImage(imageURL string) ([]byte, error) {
-	
-	resp, err := http.Get(imageURL)
-	if err != nil {
-		return nil, fmt.Errorf("failed to download image: %v", err)
+// Rendition describes one output produced from every source image.
+// An empty Format lets OutputFormats pick one based on the source format.
+type Rendition struct {
+	Name      string `json:"name"`
+	MaxWidth  int    `json:"max_width"`
+	MaxHeight int    `json:"max_height"`
+	Quality   int    `json:"quality"`
+	Format    string `json:"format,omitempty"`
+}
+
+// CompressedImage is one encoded rendition of a source image.
+type CompressedImage struct {
+	Rendition string
+	Spec      Rendition
+	Format    string
+	Width     int
+	Height    int
+	Data      []byte
+}
+
+// Result holds every rendition of one source image along with
+// what was learned about the source while producing them.
+type Result struct {
+	SourceFormat string
+	SourceWidth  int
+	SourceHeight int
+	SourceBytes  int
+	Metadata     MetadataReport
+	Renditions   []CompressedImage
+}
+
+// renditions generated for each product image, can be overridden by config
+var Renditions = []Rendition{
+	{Name: "thumbnail", MaxWidth: 150, MaxHeight: 150, Quality: 70},
+	{Name: "card", MaxWidth: 800, MaxHeight: 600, Quality: 75},
+	{Name: "zoom", MaxWidth: 1600, MaxHeight: 1200, Quality: 85},
+}
+
+// loads and decodes the image once, then encodes every rendition.
+// Outputs never carry source metadata other than allowlisted fields.
+func CompressImage(imageURL string, renditions []Rendition) (*Result, error) {
+	if len(renditions) == 0 {
+		return nil, fmt.Errorf("no renditions requested")
 	}
-	defer resp.Body.Close()
-	imageData, err := io.ReadAll(resp.Body)
+
+	ctx := context.Background()
+	imageData, contentType, err := openSource(ctx, imageURL)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read image data: %v", err)
+		return nil, err
 	}
 
+	sniffedFormat := DetectFormat(imageData)
+	release, err := reserveDecode(ctx, imageData, sniffedFormat)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
 
-	format := getImageFormat(imageURL)
-	src, _, err := image.Decode(bytes.NewReader(imageData))
+	src, srcFormat, err := image.Decode(bytes.NewReader(imageData))
 	if err != nil {
+		if errors.Is(err, image.ErrFormat) {
+			return nil, &UnsupportedFormatError{Format: sniffedFormat}
+		}
+		if sniffedFormat != "" {
+			return nil, fmt.Errorf("failed to decode %s image: %v", sniffedFormat, err)
+		}
 		return nil, fmt.Errorf("failed to decode image: %v", err)
 	}
-	resizedImg := resizeImage(src)
-	return compressImage(resizedImg, format)
+
+	// phone cameras store the sensor orientation in EXIF instead of rotating pixels
+	if srcFormat == "jpeg" {
+		if orientation := readOrientation(imageData); orientation > 1 {
+			src = applyOrientation(src, orientation)
+		}
+	}
+
+	// the decoded bytes are authoritative, the header is only cross-checked
+	if declared := formatFromContentType(contentType); declared != "" && declared != srcFormat {
+		log.Printf("WARNING: Image %s served as %s but content is %s", imageURL, declared, srcFormat)
+	}
+
+	report, kept := inspectMetadata(imageData, srcFormat)
+
+	outputs := make([]CompressedImage, 0, len(renditions))
+	for _, r := range renditions {
+		format := outputFormat(srcFormat, src, r)
+
+		resizedImg := resizeImage(src, r.MaxWidth, r.MaxHeight)
+		data, err := compressImage(resizedImg, format, r.Quality)
+		if err != nil {
+			return nil, fmt.Errorf("rendition %s: %v", r.Name, err)
+		}
+		data, err = sanitizeOutput(data, format, kept)
+		if err != nil {
+			return nil, fmt.Errorf("rendition %s: failed to strip metadata: %v", r.Name, err)
+		}
+
+		bounds := resizedImg.Bounds()
+		outputs = append(outputs, CompressedImage{
+			Rendition: r.Name,
+			Spec:      r,
+			Format:    format,
+			Width:     bounds.Dx(),
+			Height:    bounds.Dy(),
+			Data:      data,
+		})
+	}
+
+	srcBounds := src.Bounds()
+	return &Result{
+		SourceFormat: srcFormat,
+		SourceWidth:  srcBounds.Dx(),
+		SourceHeight: srcBounds.Dy(),
+		SourceBytes:  len(imageData),
+		Metadata:     report,
+		Renditions:   outputs,
+	}, nil
 }
 
 
-func resizeImage(src image.Image) image.Image {
+func resizeImage(src image.Image, maxWidth, maxHeight int) image.Image {
 	srcBounds := src.Bounds()
 	srcWidth, srcHeight := srcBounds.Dx(), srcBounds.Dy()
 
@@ -58,8 +163,8 @@ func resizeImage(src image.Image) image.Image {
 	if scale >= 1 {
 		return src
 	}
-	newWidth := int(float64(srcWidth) * scale)
-	newHeight := int(float64(srcHeight) * scale)
+	newWidth := max(int(float64(srcWidth)*scale), 1)
+	newHeight := max(int(float64(srcHeight)*scale), 1)
 
 	dst := image.NewRGBA(image.Rect(0, 0, newWidth, newHeight))
 	draw.CatmullRom.Scale(dst, dst.Bounds(), src, srcBounds, draw.Over, nil)
@@ -68,45 +173,31 @@ func resizeImage(src image.Image) image.Image {
 }
 
 // compresses the image to the specified format
-func compressImage(img image.Image, format string) ([]byte, error) {
+func compressImage(img image.Image, format string, quality int) ([]byte, error) {
 	var buf bytes.Buffer
 
-	switch strings.ToLower(format) {
+	switch NormalizeFormat(format) {
 	case "png":
 		err := png.Encode(&buf, img)
 		if err != nil {
 			return nil, fmt.Errorf("failed to compress PNG: %v", err)
 		}
-	case "jpg", "jpeg":
+	case "jpeg":
 		err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality})
 		if err != nil {
 			return nil, fmt.Errorf("failed to compress JPEG: %v", err)
 		}
 	default:
-		return nil, fmt.Errorf("unsupported image format: %s", format)
+		return nil, &UnsupportedFormatError{Format: format}
 	}
 
 	return buf.Bytes(), nil
 }
 
-// determines the image format from the URL
-func getImageFormat(imageURL string) string {
-	ext := strings.ToLower(filepath.Ext(imageURL))
-	switch ext {
-	case ".png":
-		return "png"
-	case ".jpg", ".jpeg":
-		return "jpg"
-	default:
-		log.Printf("Unknown image format for URL: %s, defaulting to JPEG", imageURL)
-		return "jpg"
-	}
-}
-
 // get minimum of two float val
 func min(a, b float64) float64 {
 	if a < b {
 		return a
 	}
 	return b
-}
\ No newline at end of file
+}
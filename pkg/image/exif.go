@@ -0,0 +1,219 @@
+package image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	markerSOI  = 0xd8
+	markerSOS  = 0xda
+	markerEOI  = 0xd9
+	markerAPP1 = 0xe1
+
+	tagOrientation = 0x0112
+)
+
+var exifHeader = []byte("Exif\x00\x00")
+
+var errInvalidTIFF = errors.New("invalid TIFF structure")
+
+// a JPEG marker segment, data excludes the marker and length bytes
+type jpegSegment struct {
+	marker byte
+	offset int
+	length int
+	data   []byte
+}
+
+// walks the marker segments of a JPEG up to the start of scan
+func jpegSegments(data []byte) []jpegSegment {
+	if len(data) < 4 || data[0] != 0xff || data[1] != markerSOI {
+		return nil
+	}
+
+	var segments []jpegSegment
+	pos := 2
+	for pos+4 <= len(data) {
+		if data[pos] != 0xff {
+			break
+		}
+		marker := data[pos+1]
+		if marker == 0xff {
+			// fill byte
+			pos++
+			continue
+		}
+		if marker == markerSOS || marker == markerEOI {
+			break
+		}
+		size := int(binary.BigEndian.Uint16(data[pos+2 : pos+4]))
+		if size < 2 || pos+2+size > len(data) {
+			break
+		}
+		segments = append(segments, jpegSegment{
+			marker: marker,
+			offset: pos,
+			length: size + 2,
+			data:   data[pos+4 : pos+2+size],
+		})
+		pos += 2 + size
+	}
+	return segments
+}
+
+// returns the TIFF payload of the first EXIF APP1 segment
+func jpegExif(data []byte) []byte {
+	for _, seg := range jpegSegments(data) {
+		if seg.marker == markerAPP1 && bytes.HasPrefix(seg.data, exifHeader) {
+			return seg.data[len(exifHeader):]
+		}
+	}
+	return nil
+}
+
+type ifdEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	value []byte // raw 4 byte value/offset field
+}
+
+// minimal reader for the TIFF structure inside an EXIF block
+type tiffReader struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+func newTIFFReader(data []byte) (*tiffReader, error) {
+	if len(data) < 8 {
+		return nil, errInvalidTIFF
+	}
+	var order binary.ByteOrder
+	switch string(data[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, errInvalidTIFF
+	}
+	if order.Uint16(data[2:4]) != 42 {
+		return nil, errInvalidTIFF
+	}
+	return &tiffReader{data: data, order: order}, nil
+}
+
+// offset of the first IFD
+func (t *tiffReader) firstIFD() uint32 {
+	return t.order.Uint32(t.data[4:8])
+}
+
+// reads the entries of the IFD at offset and the offset of the next IFD
+func (t *tiffReader) readIFD(offset uint32) ([]ifdEntry, uint32, error) {
+	start := int(offset)
+	if offset == 0 || start+2 > len(t.data) {
+		return nil, 0, errInvalidTIFF
+	}
+	count := int(t.order.Uint16(t.data[start : start+2]))
+	end := start + 2 + count*12
+	if end+4 > len(t.data) {
+		return nil, 0, errInvalidTIFF
+	}
+
+	entries := make([]ifdEntry, 0, count)
+	for i := 0; i < count; i++ {
+		e := t.data[start+2+i*12 : start+2+(i+1)*12]
+		entries = append(entries, ifdEntry{
+			tag:   t.order.Uint16(e[0:2]),
+			typ:   t.order.Uint16(e[2:4]),
+			count: t.order.Uint32(e[4:8]),
+			value: e[8:12],
+		})
+	}
+	return entries, t.order.Uint32(t.data[end : end+4]), nil
+}
+
+// value of a SHORT or LONG entry
+func (t *tiffReader) uintValue(e ifdEntry) uint32 {
+	switch e.typ {
+	case 3: // SHORT
+		return uint32(t.order.Uint16(e.value[0:2]))
+	case 4: // LONG
+		return t.order.Uint32(e.value)
+	}
+	return 0
+}
+
+// reads the EXIF orientation tag of a JPEG, 1 (upright) when absent
+func readOrientation(data []byte) int {
+	exif := jpegExif(data)
+	if exif == nil {
+		return 1
+	}
+	t, err := newTIFFReader(exif)
+	if err != nil {
+		return 1
+	}
+	entries, _, err := t.readIFD(t.firstIFD())
+	if err != nil {
+		return 1
+	}
+	for _, e := range entries {
+		if e.tag == tagOrientation {
+			if o := int(t.uintValue(e)); o >= 1 && o <= 8 {
+				return o
+			}
+		}
+	}
+	return 1
+}
+
+// value of an ASCII entry without the trailing NUL
+func (t *tiffReader) asciiValue(e ifdEntry) string {
+	if e.typ != 2 || e.count == 0 {
+		return ""
+	}
+	var raw []byte
+	if e.count <= 4 {
+		raw = e.value[:e.count]
+	} else {
+		offset := int(t.order.Uint32(e.value))
+		if offset < 0 || offset+int(e.count) > len(t.data) {
+			return ""
+		}
+		raw = t.data[offset : offset+int(e.count)]
+	}
+	return string(bytes.TrimRight(raw, "\x00"))
+}
+
+// builds a big-endian TIFF block holding only the given ASCII tags of IFD0
+func buildTIFF(tags []uint16, values map[uint16]string) []byte {
+	order := binary.BigEndian
+	ifdSize := 2 + 12*len(tags) + 4
+	dataOffset := 8 + ifdSize
+
+	out := make([]byte, dataOffset)
+	copy(out, "MM\x00\x2a")
+	order.PutUint32(out[4:8], 8)
+	order.PutUint16(out[8:10], uint16(len(tags)))
+
+	for i, tag := range tags {
+		value := append([]byte(values[tag]), 0)
+		e := out[10+i*12 : 10+(i+1)*12]
+		order.PutUint16(e[0:2], tag)
+		order.PutUint16(e[2:4], 2) // ASCII
+		order.PutUint32(e[4:8], uint32(len(value)))
+		if len(value) <= 4 {
+			copy(e[8:12], value)
+			continue
+		}
+		order.PutUint32(e[8:12], uint32(len(out)))
+		out = append(out, value...)
+		if len(out)%2 == 1 {
+			out = append(out, 0)
+		}
+	}
+	return out
+}
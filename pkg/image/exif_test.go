@@ -0,0 +1,48 @@
+package image
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func jpegWithExif(t *testing.T, tiff []byte) []byte {
+	t.Helper()
+	return withJPEGSegments(encodeJPEG(t, testImage(2, 2)),
+		jpegSegmentBytes(markerAPP1, append(append([]byte{}, exifHeader...), tiff...)))
+}
+
+func TestReadOrientation(t *testing.T) {
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		for o := 1; o <= 8; o++ {
+			for _, typ := range []uint16{3, 4} {
+				data := jpegWithExif(t, makeTIFF(order, []tiffTag{
+					{tag: tagMake, typ: 2, text: "Camera Co"},
+					{tag: tagOrientation, typ: typ, num: uint32(o)},
+				}, nil))
+				if got := readOrientation(data); got != o {
+					t.Errorf("%s type %d: orientation = %d, want %d", order, typ, got, o)
+				}
+			}
+		}
+	}
+}
+
+func TestReadOrientationDefaultsToUpright(t *testing.T) {
+	tests := map[string][]byte{
+		"no exif":                  encodeJPEG(t, testImage(2, 2)),
+		"not a jpeg":               []byte("not an image"),
+		"ifd offset out of bounds": jpegWithExif(t, makeTIFFHeader(binary.LittleEndian, 0xfffffff0)),
+		"ifd offset past end":      jpegWithExif(t, makeTIFFHeader(binary.BigEndian, 8)),
+		"entry count past end":     jpegWithExif(t, append(makeTIFFHeader(binary.BigEndian, 8), 0x00, 0x20)),
+		"zero ifd offset":          jpegWithExif(t, makeTIFFHeader(binary.LittleEndian, 0)),
+		"invalid value": jpegWithExif(t, makeTIFF(binary.LittleEndian,
+			[]tiffTag{{tag: tagOrientation, typ: 3, num: 9}}, nil)),
+		"wrong type": jpegWithExif(t, makeTIFF(binary.BigEndian,
+			[]tiffTag{{tag: tagOrientation, typ: 2, text: "6"}}, nil)),
+	}
+	for name, data := range tests {
+		if got := readOrientation(data); got != 1 {
+			t.Errorf("%s: orientation = %d, want 1", name, got)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package image
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// reasons a FetchError can carry
+const (
+	FetchSchemeNotAllowed = "scheme_not_allowed"
+	FetchBlockedAddress   = "blocked_address"
+	FetchTooLarge         = "too_large"
+	FetchTooManyRedirects = "too_many_redirects"
+	FetchBadContentType   = "bad_content_type"
+	FetchBadStatus        = "bad_status"
+	FetchTimeout          = "timeout"
+	FetchFailed           = "failed"
+)
+
+// FetchError is returned when a download is rejected or fails.
+type FetchError struct {
+	Reason string
+	URL    string
+	Err    error
+}
+
+func (e *FetchError) Error() string {
+	return fmt.Sprintf("failed to load image %s (%s): %v", e.URL, e.Reason, e.Err)
+}
+
+func (e *FetchError) Unwrap() error {
+	return e.Err
+}
+
+type FetcherConfig struct {
+	ConnectTimeout time.Duration
+	// covers waiting for the response and reading the whole body
+	ReadTimeout    time.Duration
+	MaxBytes       int64
+	MaxRedirects   int
+	AllowedSchemes []string
+	// only meant for local development against servers on localhost
+	AllowPrivateNetworks bool
+}
+
+var DefaultFetcherConfig = FetcherConfig{
+	ConnectTimeout: 5 * time.Second,
+	ReadTimeout:    30 * time.Second,
+	MaxBytes:       20 << 20,
+	MaxRedirects:   3,
+	AllowedSchemes: []string{"http", "https"},
+}
+
+// Fetcher downloads remote images within the configured limits.
+type Fetcher struct {
+	cfg    FetcherConfig
+	client *http.Client
+}
+
+// fetcher used by CompressImage, can be replaced by config
+var DefaultFetcher = NewFetcher(DefaultFetcherConfig)
+
+// ranges that aren't covered by the net.IP helpers
+var blockedNetworks = mustParseCIDRs(
+	"0.0.0.0/8",
+	"100.64.0.0/10",
+	"192.0.0.0/24",
+	"198.18.0.0/15",
+	"240.0.0.0/4",
+	"64:ff9b::/96",
+)
+
+func NewFetcher(cfg FetcherConfig) *Fetcher {
+	f := &Fetcher{cfg: cfg}
+
+	dialer := &net.Dialer{
+		Timeout: cfg.ConnectTimeout,
+		// runs after DNS resolution, so hostnames pointing inside are caught too
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || (!cfg.AllowPrivateNetworks && isBlockedIP(ip)) {
+				return &FetchError{Reason: FetchBlockedAddress, URL: address, Err: fmt.Errorf("address %s is not allowed", host)}
+			}
+			return nil
+		},
+	}
+
+	f.client = &http.Client{
+		Transport: &http.Transport{
+			// a proxy would make the address check meaningless
+			Proxy:                 nil,
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   cfg.ConnectTimeout,
+			ResponseHeaderTimeout: cfg.ReadTimeout,
+			MaxIdleConnsPerHost:   4,
+			IdleConnTimeout:       90 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > cfg.MaxRedirects {
+				return &FetchError{Reason: FetchTooManyRedirects, URL: req.URL.String(), Err: fmt.Errorf("stopped after %d redirects", cfg.MaxRedirects)}
+			}
+			return f.checkScheme(req.URL)
+		},
+	}
+
+	return f
+}
+
+// downloads rawURL and returns its body and Content-Type
+func (f *Fetcher) Fetch(ctx context.Context, rawURL string) ([]byte, string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, "", &FetchError{Reason: FetchFailed, URL: rawURL, Err: err}
+	}
+	if err := f.checkScheme(u); err != nil {
+		return nil, "", err
+	}
+
+	if f.cfg.ReadTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, f.cfg.ReadTimeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, "", &FetchError{Reason: FetchFailed, URL: rawURL, Err: err}
+	}
+	req.Header.Set("Accept", "image/*")
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, "", f.wrapError(rawURL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", &FetchError{Reason: FetchBadStatus, URL: rawURL, Err: fmt.Errorf("unexpected status %s", resp.Status)}
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+	if !isImageContentType(contentType) {
+		return nil, "", &FetchError{Reason: FetchBadContentType, URL: rawURL, Err: fmt.Errorf("content type %q is not an image", contentType)}
+	}
+
+	if f.cfg.MaxBytes > 0 && resp.ContentLength > f.cfg.MaxBytes {
+		return nil, "", &FetchError{Reason: FetchTooLarge, URL: rawURL, Err: fmt.Errorf("declared size %d exceeds %d bytes", resp.ContentLength, f.cfg.MaxBytes)}
+	}
+
+	body := io.Reader(resp.Body)
+	if f.cfg.MaxBytes > 0 {
+		// one extra byte tells us the limit was crossed
+		body = io.LimitReader(resp.Body, f.cfg.MaxBytes+1)
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, "", f.wrapError(rawURL, err)
+	}
+	if f.cfg.MaxBytes > 0 && int64(len(data)) > f.cfg.MaxBytes {
+		return nil, "", &FetchError{Reason: FetchTooLarge, URL: rawURL, Err: fmt.Errorf("body exceeds %d bytes", f.cfg.MaxBytes)}
+	}
+
+	return data, contentType, nil
+}
+
+func (f *Fetcher) checkScheme(u *url.URL) error {
+	for _, scheme := range f.cfg.AllowedSchemes {
+		if strings.EqualFold(u.Scheme, scheme) {
+			return nil
+		}
+	}
+	return &FetchError{Reason: FetchSchemeNotAllowed, URL: u.String(), Err: fmt.Errorf("scheme %q is not allowed", u.Scheme)}
+}
+
+// turns transport errors into FetchErrors, keeping the reason of ours
+func (f *Fetcher) wrapError(rawURL string, err error) error {
+	var fe *FetchError
+	if errors.As(err, &fe) {
+		return &FetchError{Reason: fe.Reason, URL: rawURL, Err: fe.Err}
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return &FetchError{Reason: FetchTimeout, URL: rawURL, Err: err}
+	}
+	return &FetchError{Reason: FetchFailed, URL: rawURL, Err: err}
+}
+
+// S3 serves objects without an explicit type as binary/octet-stream
+func isImageContentType(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(mediaType, "image/") ||
+		mediaType == "application/octet-stream" ||
+		mediaType == "binary/octet-stream"
+}
+
+func isBlockedIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return true
+	}
+	for _, network := range blockedNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
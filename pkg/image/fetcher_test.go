@@ -0,0 +1,249 @@
+package image
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func fetchReason(err error) string {
+	var fe *FetchError
+	if errors.As(err, &fe) {
+		return fe.Reason
+	}
+	return ""
+}
+
+func testFetcherConfig() FetcherConfig {
+	cfg := DefaultFetcherConfig
+	cfg.ConnectTimeout = 2 * time.Second
+	cfg.ReadTimeout = 5 * time.Second
+	return cfg
+}
+
+// lets the fetcher reach srv on loopback while every other address still
+// goes through the address check
+func trustServer(f *Fetcher, srv *httptest.Server) {
+	orig := f.client.Transport.(*http.Transport)
+	tr := orig.Clone()
+	addr := srv.Listener.Addr().String()
+	tr.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		if address == addr {
+			var d net.Dialer
+			return d.DialContext(ctx, network, address)
+		}
+		return orig.DialContext(ctx, network, address)
+	}
+	f.client.Transport = tr
+}
+
+func TestIsBlockedIP(t *testing.T) {
+	tests := []struct {
+		ip      string
+		blocked bool
+	}{
+		{"127.0.0.1", true},
+		{"127.8.9.10", true},
+		{"::1", true},
+		{"::ffff:127.0.0.1", true},
+		{"169.254.169.254", true},
+		{"10.0.0.1", true},
+		{"172.16.5.4", true},
+		{"172.31.255.255", true},
+		{"192.168.1.1", true},
+		{"100.64.0.1", true},
+		{"100.127.255.254", true},
+		{"0.0.0.0", true},
+		{"::", true},
+		{"fc00::1", true},
+		{"fd12:3456:789a::1", true},
+		{"fe80::1", true},
+		{"ff02::1", true},
+		{"224.0.0.1", true},
+		{"64:ff9b::a9fe:a9fe", true},
+		{"8.8.8.8", false},
+		{"1.1.1.1", false},
+		{"100.128.0.1", false},
+		{"172.32.0.1", false},
+		{"2606:4700:4700::1111", false},
+	}
+	for _, tt := range tests {
+		ip := net.ParseIP(tt.ip)
+		if ip == nil {
+			t.Fatalf("bad test IP %q", tt.ip)
+		}
+		if got := isBlockedIP(ip); got != tt.blocked {
+			t.Errorf("isBlockedIP(%s) = %t, want %t", tt.ip, got, tt.blocked)
+		}
+	}
+}
+
+func TestFetchRejectsBlockedAddresses(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("png"))
+	}))
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+
+	f := NewFetcher(testFetcherConfig())
+	// the dial is refused before connecting, so none of these needs a network
+	urls := []string{
+		srv.URL,
+		"http://localhost:" + port + "/",
+		"http://169.254.169.254/latest/meta-data/",
+		"http://10.0.0.1/a.png",
+		"http://172.16.0.1/a.png",
+		"http://192.168.0.1/a.png",
+		"http://100.64.0.1/a.png",
+		"http://0.0.0.0:" + port + "/",
+	}
+	for _, u := range urls {
+		_, _, err := f.Fetch(context.Background(), u)
+		if reason := fetchReason(err); reason != FetchBlockedAddress {
+			t.Errorf("Fetch(%s) = %v, want reason %s", u, err, FetchBlockedAddress)
+		}
+	}
+
+	cfg := testFetcherConfig()
+	cfg.AllowPrivateNetworks = true
+	data, _, err := NewFetcher(cfg).Fetch(context.Background(), srv.URL)
+	if err != nil || string(data) != "png" {
+		t.Errorf("Fetch with private networks allowed = %q, %v", data, err)
+	}
+}
+
+func TestFetchRejectsDisallowedSchemes(t *testing.T) {
+	f := NewFetcher(testFetcherConfig())
+	for _, u := range []string{"file:///etc/passwd", "ftp://example.com/a.png", "gopher://example.com/", "data:image/png;base64,AAAA"} {
+		_, _, err := f.Fetch(context.Background(), u)
+		if reason := fetchReason(err); reason != FetchSchemeNotAllowed {
+			t.Errorf("Fetch(%s) = %v, want reason %s", u, err, FetchSchemeNotAllowed)
+		}
+	}
+}
+
+func TestFetchRejectsUnsafeRedirects(t *testing.T) {
+	targets := map[string]string{
+		"/metadata": "http://169.254.169.254/latest/meta-data/",
+		"/private":  "http://10.1.2.3/a.png",
+		"/cgnat":    "http://100.100.100.200/a.png",
+		"/loopback": "http://127.0.0.2/a.png",
+		"/file":     "file:///etc/passwd",
+		"/ftp":      "ftp://example.com/a.png",
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, targets[r.URL.Path], http.StatusFound)
+	}))
+	defer srv.Close()
+
+	f := NewFetcher(testFetcherConfig())
+	trustServer(f, srv)
+
+	want := map[string]string{
+		"/metadata": FetchBlockedAddress,
+		"/private":  FetchBlockedAddress,
+		"/cgnat":    FetchBlockedAddress,
+		"/loopback": FetchBlockedAddress,
+		"/file":     FetchSchemeNotAllowed,
+		"/ftp":      FetchSchemeNotAllowed,
+	}
+	for path, reason := range want {
+		_, _, err := f.Fetch(context.Background(), srv.URL+path)
+		if got := fetchReason(err); got != reason {
+			t.Errorf("redirect %s to %s: %v, want reason %s", path, targets[path], err, reason)
+		}
+	}
+}
+
+func TestFetchMaxRedirects(t *testing.T) {
+	// /r/N redirects N more times before serving the image
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/r/"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		if n > 0 {
+			http.Redirect(w, r, fmt.Sprintf("/r/%d", n-1), http.StatusFound)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("png"))
+	}))
+	defer srv.Close()
+
+	for _, max := range []int{0, 1, 3} {
+		cfg := testFetcherConfig()
+		cfg.MaxRedirects = max
+		f := NewFetcher(cfg)
+		trustServer(f, srv)
+
+		if _, _, err := f.Fetch(context.Background(), fmt.Sprintf("%s/r/%d", srv.URL, max)); err != nil {
+			t.Errorf("MaxRedirects %d: %d redirects failed: %v", max, max, err)
+		}
+		_, _, err := f.Fetch(context.Background(), fmt.Sprintf("%s/r/%d", srv.URL, max+1))
+		if reason := fetchReason(err); reason != FetchTooManyRedirects {
+			t.Errorf("MaxRedirects %d: %d redirects = %v, want reason %s", max, max+1, err, FetchTooManyRedirects)
+		}
+	}
+}
+
+func TestFetchMaxBytes(t *testing.T) {
+	const limit = 1024
+
+	// /<size> serves size bytes, /chunked/<size> without a Content-Length
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, chunked := strings.CutPrefix(r.URL.Path, "/chunked")
+		size, err := strconv.Atoi(strings.TrimPrefix(path, "/"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "image/jpeg")
+		if chunked {
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+		} else {
+			w.Header().Set("Content-Length", strconv.Itoa(size))
+		}
+		w.Write([]byte(strings.Repeat("x", size)))
+	}))
+	defer srv.Close()
+
+	cfg := testFetcherConfig()
+	cfg.MaxBytes = limit
+	f := NewFetcher(cfg)
+	trustServer(f, srv)
+
+	tests := []struct {
+		path   string
+		size   int
+		reason string
+	}{
+		{"/%d", limit, ""},
+		{"/%d", limit + 1, FetchTooLarge},
+		{"/%d", 10 * limit, FetchTooLarge},
+		{"/chunked/%d", limit, ""},
+		{"/chunked/%d", limit + 1, FetchTooLarge},
+		{"/chunked/%d", 10 * limit, FetchTooLarge},
+	}
+	for _, tt := range tests {
+		u := srv.URL + fmt.Sprintf(tt.path, tt.size)
+		data, _, err := f.Fetch(context.Background(), u)
+		if reason := fetchReason(err); reason != tt.reason {
+			t.Errorf("Fetch(%s) = %v, want reason %q", u, err, tt.reason)
+			continue
+		}
+		if tt.reason == "" && len(data) != tt.size {
+			t.Errorf("Fetch(%s) returned %d bytes, want %d", u, len(data), tt.size)
+		}
+	}
+}
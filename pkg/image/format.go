@@ -0,0 +1,127 @@
+package image
+
+import (
+	"bytes"
+	"image"
+	"mime"
+	"strings"
+)
+
+// picks png when the image has transparency and jpeg otherwise
+const AutoFormat = "auto"
+
+// maps a detected input format to the format renditions are encoded in,
+// can be overridden by config
+var OutputFormats = map[string]string{
+	"jpeg": "jpeg",
+	"png":  "png",
+	"gif":  "png",
+	"webp": AutoFormat,
+	"bmp":  "jpeg",
+	"tiff": AutoFormat,
+}
+
+// used when the detected input format has no entry in OutputFormats
+var DefaultOutputFormat = "jpeg"
+
+// magic numbers of the formats we know how to recognise
+var signatures = []struct {
+	format string
+	prefix []byte
+}{
+	{"jpeg", []byte("\xff\xd8\xff")},
+	{"png", []byte("\x89PNG\r\n\x1a\n")},
+	{"gif", []byte("GIF87a")},
+	{"gif", []byte("GIF89a")},
+	{"bmp", []byte("BM")},
+	{"tiff", []byte("II*\x00")},
+	{"tiff", []byte("MM\x00*")},
+}
+
+// DetectFormat identifies the image format from its leading bytes,
+// returns an empty string when the content is not a known image.
+func DetectFormat(data []byte) string {
+	if len(data) >= 12 && bytes.Equal(data[0:4], []byte("RIFF")) && bytes.Equal(data[8:12], []byte("WEBP")) {
+		return "webp"
+	}
+	for _, sig := range signatures {
+		if bytes.HasPrefix(data, sig.prefix) {
+			return sig.format
+		}
+	}
+	return ""
+}
+
+// NormalizeFormat maps format aliases to the names used by the decoders.
+func NormalizeFormat(format string) string {
+	format = strings.ToLower(strings.TrimPrefix(format, "."))
+	switch format {
+	case "jpg", "jpe", "pjpeg":
+		return "jpeg"
+	case "tif":
+		return "tiff"
+	case "x-ms-bmp":
+		return "bmp"
+	}
+	return format
+}
+
+// extracts the image format from a Content-Type header value
+func formatFromContentType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || !strings.HasPrefix(mediaType, "image/") {
+		return ""
+	}
+	return NormalizeFormat(strings.TrimPrefix(mediaType, "image/"))
+}
+
+// picks the encoding for a rendition, an explicit rendition format wins over the policy
+func outputFormat(srcFormat string, src image.Image, r Rendition) string {
+	format := DefaultOutputFormat
+	if r.Format != "" {
+		format = NormalizeFormat(r.Format)
+	} else if f, ok := OutputFormats[srcFormat]; ok {
+		format = f
+	}
+
+	if format == AutoFormat {
+		if isOpaque(src) {
+			return "jpeg"
+		}
+		return "png"
+	}
+	return format
+}
+
+// reports whether every pixel is fully opaque
+func isOpaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if _, _, _, a := img.At(x, y).RGBA(); a != 0xffff {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// ContentType returns the MIME type of a format name.
+func ContentType(format string) string {
+	switch format = NormalizeFormat(format); format {
+	case "jpeg", "png", "gif", "webp", "bmp", "tiff":
+		return "image/" + format
+	}
+	return "application/octet-stream"
+}
+
+// file extension used for objects stored in a format
+func Extension(format string) string {
+	if format = NormalizeFormat(format); format == "jpeg" {
+		return "jpg"
+	}
+	return format
+}
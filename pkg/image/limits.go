@@ -0,0 +1,77 @@
+package image
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"sync"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// dimension limits checked before an image is decoded, can be overridden by config
+var (
+	MaxPixels int64 = 40_000_000
+	MaxSide         = 12_000
+)
+
+// decoded pixels plus the working copies made while orienting and resizing
+const bytesPerPixel = 8
+
+// DimensionError is returned when an image declares more pixels than allowed.
+type DimensionError struct {
+	Width  int
+	Height int
+}
+
+func (e *DimensionError) Error() string {
+	return fmt.Sprintf("image dimensions %dx%d exceed the limit of %d pixels or %d per side", e.Width, e.Height, MaxPixels, MaxSide)
+}
+
+var (
+	decodeMu        sync.Mutex
+	decodeMemory    int64 = 512 << 20
+	decodeSemaphore       = semaphore.NewWeighted(decodeMemory)
+)
+
+// caps the memory all concurrent decodes in the process may use together
+func SetDecodeMemoryLimit(limit int64) {
+	decodeMu.Lock()
+	defer decodeMu.Unlock()
+	decodeMemory = limit
+	decodeSemaphore = semaphore.NewWeighted(limit)
+}
+
+// reads only the header to validate dimensions, then waits for enough
+// decode memory; the returned func gives the memory back
+func reserveDecode(ctx context.Context, data []byte, sniffedFormat string) (func(), error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		if errors.Is(err, image.ErrFormat) {
+			return nil, &UnsupportedFormatError{Format: sniffedFormat}
+		}
+		return nil, fmt.Errorf("failed to read image header: %v", err)
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 {
+		return nil, fmt.Errorf("image has invalid dimensions %dx%d", cfg.Width, cfg.Height)
+	}
+	if cfg.Width > MaxSide || cfg.Height > MaxSide || int64(cfg.Width)*int64(cfg.Height) > MaxPixels {
+		return nil, &DimensionError{Width: cfg.Width, Height: cfg.Height}
+	}
+
+	decodeMu.Lock()
+	sem, limit := decodeSemaphore, decodeMemory
+	decodeMu.Unlock()
+
+	// an image bigger than the whole budget still runs, just on its own
+	cost := int64(cfg.Width) * int64(cfg.Height) * bytesPerPixel
+	if cost > limit {
+		cost = limit
+	}
+	if err := sem.Acquire(ctx, cost); err != nil {
+		return nil, err
+	}
+	return func() { sem.Release(cost) }, nil
+}
@@ -0,0 +1,323 @@
+package image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"sort"
+)
+
+// metadata fields that may survive stripping when allowlisted,
+// keyed by name with their EXIF tag and PNG keyword
+var KeepableMetadata = map[string]struct {
+	Tag        uint16
+	PNGKeyword string
+}{
+	"Copyright": {0x8298, "Copyright"},
+	"Artist":    {0x013b, "Author"},
+}
+
+// names from KeepableMetadata copied into every output, can be overridden by config
+var MetadataAllowlist []string
+
+// MetadataReport lists what was found in a source image and dropped,
+// and which allowlisted fields were carried over.
+type MetadataReport struct {
+	Removed []string `json:"removed,omitempty"`
+	Kept    []string `json:"kept,omitempty"`
+}
+
+const (
+	tagExifIFD      = 0x8769
+	tagGPSIFD       = 0x8825
+	tagMake         = 0x010f
+	tagModel        = 0x0110
+	tagCameraSerial = 0xc62f
+	tagBodySerial   = 0xa431
+	tagLensSerial   = 0xa435
+	markerAPP2      = 0xe2
+	markerAPP13     = 0xed
+	markerCOM       = 0xfe
+)
+
+var (
+	pngSignature = []byte("\x89PNG\r\n\x1a\n")
+	xmpHeader    = []byte("http://ns.adobe.com/xap/1.0/\x00")
+)
+
+// scans the source image for metadata and collects allowlisted values
+func inspectMetadata(data []byte, format string) (MetadataReport, map[string]string) {
+	found := make(map[string]bool)
+	values := make(map[string]string)
+
+	switch format {
+	case "jpeg":
+		for _, seg := range jpegSegments(data) {
+			switch {
+			case seg.marker == markerAPP1 && bytes.HasPrefix(seg.data, exifHeader):
+				inspectExif(seg.data[len(exifHeader):], found, values)
+			case seg.marker == markerAPP1 && bytes.HasPrefix(seg.data, xmpHeader):
+				found["xmp"] = true
+			case seg.marker == markerAPP13:
+				found["iptc"] = true
+			case seg.marker == markerAPP2 && bytes.HasPrefix(seg.data, []byte("ICC_PROFILE")):
+				found["icc_profile"] = true
+			case seg.marker == markerCOM:
+				found["comment"] = true
+			}
+		}
+	case "png":
+		for _, c := range pngChunks(data) {
+			switch c.typ {
+			case "eXIf":
+				inspectExif(c.data, found, values)
+			case "iCCP":
+				found["icc_profile"] = true
+			case "tEXt", "zTXt", "iTXt":
+				keyword, text, _ := bytes.Cut(c.data, []byte{0})
+				switch k := string(keyword); {
+				case k == "XML:com.adobe.xmp":
+					found["xmp"] = true
+				case k == "Raw profile type iptc":
+					found["iptc"] = true
+				default:
+					found["text"] = true
+					if c.typ == "tEXt" {
+						for name, field := range KeepableMetadata {
+							if field.PNGKeyword == k {
+								values[name] = string(text)
+							}
+						}
+					}
+				}
+			}
+		}
+	case "webp":
+		for _, c := range webpChunks(data) {
+			switch c.typ {
+			case "EXIF":
+				inspectExif(bytes.TrimPrefix(c.data, exifHeader), found, values)
+			case "XMP ":
+				found["xmp"] = true
+			case "ICCP":
+				found["icc_profile"] = true
+			}
+		}
+	case "tiff":
+		// the whole file is a TIFF structure, its tags are metadata too
+		inspectExif(data, found, values)
+	}
+
+	var report MetadataReport
+	for category := range found {
+		report.Removed = append(report.Removed, category)
+	}
+	sort.Strings(report.Removed)
+
+	kept := make(map[string]string)
+	for _, name := range MetadataAllowlist {
+		if v, ok := values[name]; ok && v != "" {
+			kept[name] = v
+			report.Kept = append(report.Kept, name)
+		}
+	}
+	return report, kept
+}
+
+// records the privacy-relevant parts of an EXIF block
+func inspectExif(exif []byte, found map[string]bool, values map[string]string) {
+	found["exif"] = true
+
+	t, err := newTIFFReader(exif)
+	if err != nil {
+		return
+	}
+	entries, next, err := t.readIFD(t.firstIFD())
+	if err != nil {
+		return
+	}
+	if next != 0 {
+		found["exif.thumbnail"] = true
+	}
+
+	for _, e := range entries {
+		switch e.tag {
+		case tagGPSIFD:
+			found["exif.gps"] = true
+		case tagMake, tagModel:
+			found["exif.camera_model"] = true
+		case tagCameraSerial:
+			found["exif.camera_serial"] = true
+		case tagExifIFD:
+			sub, _, err := t.readIFD(t.uintValue(e))
+			if err != nil {
+				continue
+			}
+			for _, se := range sub {
+				if se.tag == tagBodySerial || se.tag == tagLensSerial {
+					found["exif.camera_serial"] = true
+				}
+			}
+		}
+		for name, field := range KeepableMetadata {
+			if e.tag == field.Tag {
+				values[name] = t.asciiValue(e)
+			}
+		}
+	}
+}
+
+// removes every metadata block from an encoded output and writes back
+// only the kept fields
+func sanitizeOutput(data []byte, format string, kept map[string]string) ([]byte, error) {
+	switch format {
+	case "jpeg":
+		return sanitizeJPEG(data, kept)
+	case "png":
+		return sanitizePNG(data, kept)
+	}
+	return nil, &UnsupportedFormatError{Format: format}
+}
+
+func sanitizeJPEG(data []byte, kept map[string]string) ([]byte, error) {
+	segments := jpegSegments(data)
+	if segments == nil {
+		return nil, fmt.Errorf("encoded JPEG is malformed")
+	}
+
+	out := make([]byte, 0, len(data)+256)
+	out = append(out, 0xff, markerSOI)
+
+	// keep JFIF (APP0) first as readers expect it there
+	rest := 2
+	for _, seg := range segments {
+		if seg.marker == 0xe0 {
+			out = append(out, data[seg.offset:seg.offset+seg.length]...)
+		}
+		rest = seg.offset + seg.length
+	}
+
+	if len(kept) > 0 {
+		tags, values := keptTags(kept)
+		payload := append(append([]byte{}, exifHeader...), buildTIFF(tags, values)...)
+		if len(payload)+2 > 0xffff {
+			return nil, fmt.Errorf("kept metadata is too large")
+		}
+		out = append(out, 0xff, markerAPP1, 0, 0)
+		binary.BigEndian.PutUint16(out[len(out)-2:], uint16(len(payload)+2))
+		out = append(out, payload...)
+	}
+
+	// everything but application and comment segments is image data
+	for _, seg := range segments {
+		if seg.marker == 0xe0 || (seg.marker >= 0xe1 && seg.marker <= 0xef) || seg.marker == markerCOM {
+			continue
+		}
+		out = append(out, data[seg.offset:seg.offset+seg.length]...)
+	}
+	return append(out, data[rest:]...), nil
+}
+
+func sanitizePNG(data []byte, kept map[string]string) ([]byte, error) {
+	chunks := pngChunks(data)
+	if chunks == nil {
+		return nil, fmt.Errorf("encoded PNG is malformed")
+	}
+
+	out := make([]byte, 0, len(data)+256)
+	out = append(out, pngSignature...)
+	for _, c := range chunks {
+		switch c.typ {
+		case "tEXt", "zTXt", "iTXt", "eXIf", "iCCP", "tIME":
+			continue
+		}
+		out = appendPNGChunk(out, c.typ, c.data)
+
+		if c.typ == "IHDR" {
+			names := make([]string, 0, len(kept))
+			for name := range kept {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				text := append([]byte(KeepableMetadata[name].PNGKeyword+"\x00"), kept[name]...)
+				out = appendPNGChunk(out, "tEXt", text)
+			}
+		}
+	}
+	return out, nil
+}
+
+// kept values keyed by EXIF tag, tags in ascending order as TIFF requires
+func keptTags(kept map[string]string) ([]uint16, map[uint16]string) {
+	values := make(map[uint16]string, len(kept))
+	tags := make([]uint16, 0, len(kept))
+	for name, v := range kept {
+		tag := KeepableMetadata[name].Tag
+		values[tag] = v
+		tags = append(tags, tag)
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+	return tags, values
+}
+
+type chunk struct {
+	typ  string
+	data []byte
+}
+
+// splits a PNG into its chunks, nil when the structure is invalid
+func pngChunks(data []byte) []chunk {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil
+	}
+	var chunks []chunk
+	pos := len(pngSignature)
+	for pos+12 <= len(data) {
+		size := int(binary.BigEndian.Uint32(data[pos : pos+4]))
+		if size < 0 || pos+12+size > len(data) {
+			return nil
+		}
+		chunks = append(chunks, chunk{
+			typ:  string(data[pos+4 : pos+8]),
+			data: data[pos+8 : pos+8+size],
+		})
+		pos += 12 + size
+	}
+	return chunks
+}
+
+func appendPNGChunk(out []byte, typ string, data []byte) []byte {
+	var header [8]byte
+	binary.BigEndian.PutUint32(header[0:4], uint32(len(data)))
+	copy(header[4:8], typ)
+	out = append(out, header[:]...)
+	out = append(out, data...)
+
+	crc := crc32.NewIEEE()
+	crc.Write(header[4:8])
+	crc.Write(data)
+	return binary.BigEndian.AppendUint32(out, crc.Sum32())
+}
+
+// splits a WebP RIFF container into its chunks
+func webpChunks(data []byte) []chunk {
+	if len(data) < 12 {
+		return nil
+	}
+	var chunks []chunk
+	pos := 12
+	for pos+8 <= len(data) {
+		size := int(binary.LittleEndian.Uint32(data[pos+4 : pos+8]))
+		if size < 0 || pos+8+size > len(data) {
+			break
+		}
+		chunks = append(chunks, chunk{
+			typ:  string(data[pos : pos+4]),
+			data: data[pos+8 : pos+8+size],
+		})
+		pos += 8 + size + size%2
+	}
+	return chunks
+}
@@ -0,0 +1,402 @@
+package image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"reflect"
+	"testing"
+)
+
+const testCopyright = "(c) Jane Doe 2024"
+
+// one IFD entry of a test TIFF block, num holds SHORT and LONG values
+type tiffTag struct {
+	tag  uint16
+	typ  uint16
+	num  uint32
+	text string
+}
+
+// builds a TIFF block, sub becomes the EXIF sub-IFD when not nil
+func makeTIFF(order binary.ByteOrder, ifd0, sub []tiffTag) []byte {
+	out := make([]byte, 8)
+	if order == binary.LittleEndian {
+		copy(out, "II")
+	} else {
+		copy(out, "MM")
+	}
+	order.PutUint16(out[2:4], 42)
+
+	if sub != nil {
+		subOffset := uint32(len(out))
+		out = appendIFD(out, order, sub, 0)
+		ifd0 = append(ifd0, tiffTag{tag: tagExifIFD, typ: 4, num: subOffset})
+	}
+	order.PutUint32(out[4:8], uint32(len(out)))
+	return appendIFD(out, order, ifd0, 0)
+}
+
+func appendIFD(out []byte, order binary.ByteOrder, tags []tiffTag, next uint32) []byte {
+	start := len(out)
+	out = append(out, make([]byte, 2+12*len(tags)+4)...)
+	order.PutUint16(out[start:], uint16(len(tags)))
+	for i, tg := range tags {
+		e := start + 2 + i*12
+		order.PutUint16(out[e:], tg.tag)
+		order.PutUint16(out[e+2:], tg.typ)
+		switch tg.typ {
+		case 2:
+			value := append([]byte(tg.text), 0)
+			order.PutUint32(out[e+4:], uint32(len(value)))
+			if len(value) <= 4 {
+				copy(out[e+8:e+12], value)
+				continue
+			}
+			order.PutUint32(out[e+8:], uint32(len(out)))
+			out = append(out, value...)
+		case 3:
+			order.PutUint32(out[e+4:], 1)
+			order.PutUint16(out[e+8:], uint16(tg.num))
+		case 4:
+			order.PutUint32(out[e+4:], 1)
+			order.PutUint32(out[e+8:], tg.num)
+		}
+	}
+	order.PutUint32(out[start+2+12*len(tags):], next)
+	return out
+}
+
+// EXIF with GPS, camera model, serial numbers and a copyright
+func privateTIFF(order binary.ByteOrder) []byte {
+	return makeTIFF(order,
+		[]tiffTag{
+			{tag: tagMake, typ: 2, text: "Camera Co"},
+			{tag: tagModel, typ: 2, text: "X100"},
+			{tag: tagCameraSerial, typ: 2, text: "SN123456"},
+			{tag: KeepableMetadata["Copyright"].Tag, typ: 2, text: testCopyright},
+			{tag: tagGPSIFD, typ: 4, num: 8},
+		},
+		[]tiffTag{
+			{tag: tagBodySerial, typ: 2, text: "BODY-42"},
+			{tag: tagLensSerial, typ: 2, text: "LENS-7"},
+		},
+	)
+}
+
+func testImage(w, h int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.NRGBA{uint8(x * 16), uint8(y * 16), 128, 255})
+		}
+	}
+	return img
+}
+
+func encodeJPEG(t *testing.T, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatalf("encoding JPEG: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func encodePNG(t *testing.T, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("encoding PNG: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// inserts marker segments right after SOI
+func withJPEGSegments(data []byte, segments ...[]byte) []byte {
+	out := append([]byte{}, data[:2]...)
+	for _, seg := range segments {
+		out = append(out, seg...)
+	}
+	return append(out, data[2:]...)
+}
+
+func jpegSegmentBytes(marker byte, payload []byte) []byte {
+	seg := []byte{0xff, marker, 0, 0}
+	binary.BigEndian.PutUint16(seg[2:], uint16(len(payload)+2))
+	return append(seg, payload...)
+}
+
+// inserts chunks right after IHDR
+func withPNGChunks(t *testing.T, data []byte, extra ...chunk) []byte {
+	t.Helper()
+	chunks := pngChunks(data)
+	if chunks == nil {
+		t.Fatal("test PNG is malformed")
+	}
+	out := append([]byte{}, pngSignature...)
+	for _, c := range chunks {
+		out = appendPNGChunk(out, c.typ, c.data)
+		if c.typ == "IHDR" {
+			for _, e := range extra {
+				out = appendPNGChunk(out, e.typ, e.data)
+			}
+		}
+	}
+	return out
+}
+
+func privateJPEG(t *testing.T, order binary.ByteOrder) []byte {
+	return withJPEGSegments(encodeJPEG(t, testImage(8, 8)),
+		jpegSegmentBytes(markerAPP1, append(append([]byte{}, exifHeader...), privateTIFF(order)...)),
+		jpegSegmentBytes(markerAPP1, append(append([]byte{}, xmpHeader...), "<x:xmpmeta/>"...)),
+		jpegSegmentBytes(markerAPP13, []byte("Photoshop 3.0\x008BIM")),
+		jpegSegmentBytes(markerCOM, []byte("shot at home")),
+	)
+}
+
+func privatePNG(t *testing.T, order binary.ByteOrder) []byte {
+	return withPNGChunks(t, encodePNG(t, testImage(8, 8)),
+		chunk{"eXIf", privateTIFF(order)},
+		chunk{"tEXt", []byte("XML:com.adobe.xmp\x00<x:xmpmeta/>")},
+		chunk{"tEXt", []byte("Comment\x00shot at home")},
+		chunk{"tEXt", []byte("Copyright\x00" + testCopyright)},
+	)
+}
+
+func setAllowlist(t *testing.T, names ...string) {
+	t.Helper()
+	old := MetadataAllowlist
+	MetadataAllowlist = names
+	t.Cleanup(func() { MetadataAllowlist = old })
+}
+
+func TestInspectMetadataReportsRemovedBlocks(t *testing.T) {
+	setAllowlist(t)
+
+	tests := []struct {
+		name   string
+		format string
+		data   []byte
+		want   []string
+	}{
+		{
+			name:   "jpeg little endian",
+			format: "jpeg",
+			data:   privateJPEG(t, binary.LittleEndian),
+			want:   []string{"comment", "exif", "exif.camera_model", "exif.camera_serial", "exif.gps", "iptc", "xmp"},
+		},
+		{
+			name:   "jpeg big endian",
+			format: "jpeg",
+			data:   privateJPEG(t, binary.BigEndian),
+			want:   []string{"comment", "exif", "exif.camera_model", "exif.camera_serial", "exif.gps", "iptc", "xmp"},
+		},
+		{
+			name:   "png",
+			format: "png",
+			data:   privatePNG(t, binary.BigEndian),
+			want:   []string{"exif", "exif.camera_model", "exif.camera_serial", "exif.gps", "text", "xmp"},
+		},
+		{
+			name:   "jpeg without metadata",
+			format: "jpeg",
+			data:   encodeJPEG(t, testImage(8, 8)),
+			want:   nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report, kept := inspectMetadata(tt.data, tt.format)
+			if !reflect.DeepEqual(report.Removed, tt.want) {
+				t.Errorf("Removed = %v, want %v", report.Removed, tt.want)
+			}
+			if len(report.Kept) != 0 || len(kept) != 0 {
+				t.Errorf("kept %v (%v) without an allowlist", report.Kept, kept)
+			}
+		})
+	}
+}
+
+func TestSanitizeJPEGStripsMetadata(t *testing.T) {
+	setAllowlist(t)
+
+	data := privateJPEG(t, binary.LittleEndian)
+	_, kept := inspectMetadata(data, "jpeg")
+	out, err := sanitizeOutput(data, "jpeg", kept)
+	if err != nil {
+		t.Fatalf("sanitizeOutput: %v", err)
+	}
+
+	for _, seg := range jpegSegments(out) {
+		if seg.marker >= markerAPP1 && seg.marker <= 0xef || seg.marker == markerCOM {
+			t.Errorf("output still has segment 0x%x", seg.marker)
+		}
+	}
+	for _, secret := range []string{"SN123456", "BODY-42", "xmpmeta", "8BIM", "shot at home", testCopyright} {
+		if bytes.Contains(out, []byte(secret)) {
+			t.Errorf("output still contains %q", secret)
+		}
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(out)); err != nil {
+		t.Errorf("output doesn't decode: %v", err)
+	}
+}
+
+func TestSanitizePNGStripsMetadata(t *testing.T) {
+	setAllowlist(t)
+
+	data := privatePNG(t, binary.LittleEndian)
+	_, kept := inspectMetadata(data, "png")
+	out, err := sanitizeOutput(data, "png", kept)
+	if err != nil {
+		t.Fatalf("sanitizeOutput: %v", err)
+	}
+
+	for _, c := range pngChunks(out) {
+		switch c.typ {
+		case "tEXt", "zTXt", "iTXt", "eXIf", "iCCP", "tIME":
+			t.Errorf("output still has a %s chunk", c.typ)
+		}
+	}
+	if _, err := png.Decode(bytes.NewReader(out)); err != nil {
+		t.Errorf("output doesn't decode: %v", err)
+	}
+}
+
+func TestSanitizeKeepsAllowlistedCopyright(t *testing.T) {
+	setAllowlist(t, "Copyright")
+
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		t.Run("jpeg "+order.String(), func(t *testing.T) {
+			data := privateJPEG(t, order)
+			report, kept := inspectMetadata(data, "jpeg")
+			if !reflect.DeepEqual(report.Kept, []string{"Copyright"}) || kept["Copyright"] != testCopyright {
+				t.Fatalf("Kept = %v (%v), want Copyright %q", report.Kept, kept, testCopyright)
+			}
+
+			out, err := sanitizeOutput(data, "jpeg", kept)
+			if err != nil {
+				t.Fatalf("sanitizeOutput: %v", err)
+			}
+			exif := jpegExif(out)
+			if exif == nil {
+				t.Fatal("output has no EXIF block")
+			}
+			tr, err := newTIFFReader(exif)
+			if err != nil {
+				t.Fatalf("output EXIF: %v", err)
+			}
+			entries, _, err := tr.readIFD(tr.firstIFD())
+			if err != nil {
+				t.Fatalf("output EXIF: %v", err)
+			}
+			if len(entries) != 1 || entries[0].tag != KeepableMetadata["Copyright"].Tag {
+				t.Fatalf("output IFD0 = %+v, want only Copyright", entries)
+			}
+			if got := tr.asciiValue(entries[0]); got != testCopyright {
+				t.Errorf("Copyright = %q, want %q", got, testCopyright)
+			}
+			if bytes.Contains(out, []byte("SN123456")) || bytes.Contains(out, []byte("xmpmeta")) {
+				t.Error("output still contains removed metadata")
+			}
+		})
+	}
+
+	t.Run("png", func(t *testing.T) {
+		data := privatePNG(t, binary.BigEndian)
+		_, kept := inspectMetadata(data, "png")
+		out, err := sanitizeOutput(data, "png", kept)
+		if err != nil {
+			t.Fatalf("sanitizeOutput: %v", err)
+		}
+
+		var texts []string
+		for _, c := range pngChunks(out) {
+			switch c.typ {
+			case "tEXt":
+				texts = append(texts, string(c.data))
+			case "eXIf", "zTXt", "iTXt":
+				t.Errorf("output still has a %s chunk", c.typ)
+			}
+		}
+		want := []string{"Copyright\x00" + testCopyright}
+		if !reflect.DeepEqual(texts, want) {
+			t.Errorf("tEXt chunks = %q, want %q", texts, want)
+		}
+	})
+}
+
+func TestMetadataHandlesMalformedInput(t *testing.T) {
+	setAllowlist(t, "Copyright", "Artist")
+
+	badTIFFs := map[string][]byte{
+		"ifd offset out of bounds": makeTIFFHeader(binary.LittleEndian, 0xffffff00),
+		"entry count past end":     append(makeTIFFHeader(binary.BigEndian, 8), 0xff, 0xff),
+		"sub-ifd out of bounds": makeTIFF(binary.LittleEndian,
+			[]tiffTag{{tag: tagExifIFD, typ: 4, num: 0xfffffff0}}, nil),
+		"ascii offset out of bounds": corruptASCIIOffset(makeTIFF(binary.BigEndian,
+			[]tiffTag{{tag: KeepableMetadata["Copyright"].Tag, typ: 2, text: testCopyright}}, nil)),
+		"bad byte order": []byte("XX\x00\x2a\x00\x00\x00\x08"),
+		"too short":      []byte("II"),
+	}
+
+	inputs := map[string]struct {
+		format string
+		data   []byte
+	}{
+		"jpeg":                 {"jpeg", privateJPEG(t, binary.LittleEndian)},
+		"png":                  {"png", privatePNG(t, binary.BigEndian)},
+		"png text without nul": {"png", withPNGChunks(t, encodePNG(t, testImage(2, 2)), chunk{"tEXt", []byte("Copyright")})},
+		"jpeg short segment":   {"jpeg", []byte{0xff, markerSOI, 0xff, markerAPP1, 0x00, 0x01, 0xff, markerEOI}},
+		"jpeg long segment":    {"jpeg", []byte{0xff, markerSOI, 0xff, markerAPP1, 0xff, 0xff, 'E', 'x'}},
+		"png huge chunk":       {"png", append(append([]byte{}, pngSignature...), 0x7f, 0xff, 0xff, 0xff, 'e', 'X', 'I', 'f', 0, 0, 0, 0)},
+		"webp huge chunk":      {"webp", []byte("RIFF\x00\x00\x00\x00WEBPEXIF\xff\xff\xff\x7fII")},
+		"empty":                {"jpeg", nil},
+	}
+	for name, tiff := range badTIFFs {
+		inputs["jpeg exif "+name] = struct {
+			format string
+			data   []byte
+		}{"jpeg", withJPEGSegments(encodeJPEG(t, testImage(2, 2)),
+			jpegSegmentBytes(markerAPP1, append(append([]byte{}, exifHeader...), tiff...)))}
+		inputs["tiff "+name] = struct {
+			format string
+			data   []byte
+		}{"tiff", tiff}
+	}
+
+	for name, in := range inputs {
+		t.Run(name, func(t *testing.T) {
+			// every prefix, so each structure is also cut off at every byte
+			for n := 0; n <= len(in.data); n++ {
+				data := in.data[:n]
+				_, kept := inspectMetadata(data, in.format)
+				if in.format == "jpeg" || in.format == "png" {
+					sanitizeOutput(data, in.format, kept)
+				}
+			}
+		})
+	}
+}
+
+func makeTIFFHeader(order binary.ByteOrder, firstIFD uint32) []byte {
+	out := makeTIFF(order, nil, nil)[:8]
+	order.PutUint32(out[4:8], firstIFD)
+	return out
+}
+
+// points the first entry's value past the end of the block
+func corruptASCIIOffset(tiff []byte) []byte {
+	tr, err := newTIFFReader(tiff)
+	if err != nil {
+		panic(err)
+	}
+	first := int(tr.firstIFD())
+	tr.order.PutUint32(tiff[first+2+8:], 0xfffffff0)
+	return tiff
+}
@@ -0,0 +1,70 @@
+package image
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+var (
+	red   = color.NRGBA{255, 0, 0, 255}
+	green = color.NRGBA{0, 255, 0, 255}
+	blue  = color.NRGBA{0, 0, 255, 255}
+	white = color.NRGBA{255, 255, 255, 255}
+	gray  = color.NRGBA{128, 128, 128, 255}
+)
+
+// 3x2 image with a different color in each corner
+func cornerImage() image.Image {
+	img := image.NewNRGBA(image.Rect(0, 0, 3, 2))
+	for y := 0; y < 2; y++ {
+		for x := 0; x < 3; x++ {
+			img.Set(x, y, gray)
+		}
+	}
+	img.Set(0, 0, red)
+	img.Set(2, 0, green)
+	img.Set(0, 1, blue)
+	img.Set(2, 1, white)
+	return img
+}
+
+func TestApplyOrientation(t *testing.T) {
+	// corners of the upright image: top left, top right, bottom left, bottom right
+	tests := []struct {
+		orientation int
+		w, h        int
+		corners     [4]color.NRGBA
+	}{
+		{1, 3, 2, [4]color.NRGBA{red, green, blue, white}},
+		{2, 3, 2, [4]color.NRGBA{green, red, white, blue}},
+		{3, 3, 2, [4]color.NRGBA{white, blue, green, red}},
+		{4, 3, 2, [4]color.NRGBA{blue, white, red, green}},
+		{5, 2, 3, [4]color.NRGBA{red, blue, green, white}},
+		{6, 2, 3, [4]color.NRGBA{blue, red, white, green}},
+		{7, 2, 3, [4]color.NRGBA{white, green, blue, red}},
+		{8, 2, 3, [4]color.NRGBA{green, white, red, blue}},
+		{9, 3, 2, [4]color.NRGBA{red, green, blue, white}},
+	}
+
+	for _, tt := range tests {
+		out := applyOrientation(cornerImage(), tt.orientation)
+		b := out.Bounds()
+		if b.Dx() != tt.w || b.Dy() != tt.h {
+			t.Errorf("orientation %d: size %dx%d, want %dx%d", tt.orientation, b.Dx(), b.Dy(), tt.w, tt.h)
+			continue
+		}
+		points := [4]image.Point{
+			{b.Min.X, b.Min.Y},
+			{b.Max.X - 1, b.Min.Y},
+			{b.Min.X, b.Max.Y - 1},
+			{b.Max.X - 1, b.Max.Y - 1},
+		}
+		for i, p := range points {
+			got := color.NRGBAModel.Convert(out.At(p.X, p.Y)).(color.NRGBA)
+			if got != tt.corners[i] {
+				t.Errorf("orientation %d: pixel at %v = %v, want %v", tt.orientation, p, got, tt.corners[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package image
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// FetchError reason for sources outside what a resolver may read
+const FetchSourceNotAllowed = "source_not_allowed"
+
+// SourceResolver loads the raw bytes of an image and its content type.
+type SourceResolver interface {
+	Resolve(ctx context.Context, rawURL string) ([]byte, string, error)
+}
+
+// SourceResolverFunc adapts a function to SourceResolver.
+type SourceResolverFunc func(ctx context.Context, rawURL string) ([]byte, string, error)
+
+func (f SourceResolverFunc) Resolve(ctx context.Context, rawURL string) ([]byte, string, error) {
+	return f(ctx, rawURL)
+}
+
+// directory file:// sources are confined to, empty disables them
+var FileSourceRoot string
+
+// schemes product images may use, can be overridden by config. s3 is
+// needed for uploaded images.
+var AllowedSources = []string{"http", "https", "s3", "file", "data"}
+
+var (
+	sourcesMu sync.RWMutex
+	sources   = map[string]SourceResolver{
+		"http":  SourceResolverFunc(fetchHTTP),
+		"https": SourceResolverFunc(fetchHTTP),
+		"file":  SourceResolverFunc(readFile),
+		"data":  SourceResolverFunc(decodeDataURI),
+	}
+)
+
+// registers the resolver used for URLs with the given scheme,
+// replacing any existing one
+func RegisterSource(scheme string, r SourceResolver) {
+	sourcesMu.Lock()
+	defer sourcesMu.Unlock()
+	sources[strings.ToLower(scheme)] = r
+}
+
+// picks the resolver for the URL scheme and loads the image
+func openSource(ctx context.Context, rawURL string) ([]byte, string, error) {
+	scheme, _, ok := strings.Cut(rawURL, ":")
+	if !ok {
+		return nil, "", &FetchError{Reason: FetchSchemeNotAllowed, URL: rawURL, Err: fmt.Errorf("missing scheme")}
+	}
+
+	if !sourceAllowed(scheme) {
+		return nil, "", &FetchError{Reason: FetchSchemeNotAllowed, URL: sourceLogURL(rawURL), Err: fmt.Errorf("scheme %q is not allowed", scheme)}
+	}
+
+	sourcesMu.RLock()
+	r, ok := sources[strings.ToLower(scheme)]
+	sourcesMu.RUnlock()
+	if !ok {
+		return nil, "", &FetchError{Reason: FetchSchemeNotAllowed, URL: rawURL, Err: fmt.Errorf("no source registered for scheme %q", scheme)}
+	}
+
+	data, contentType, err := r.Resolve(ctx, rawURL)
+	if err != nil {
+		return nil, "", err
+	}
+	if limit := MaxSourceBytes(); limit > 0 && int64(len(data)) > limit {
+		return nil, "", &FetchError{Reason: FetchTooLarge, URL: rawURL, Err: fmt.Errorf("source exceeds %d bytes", limit)}
+	}
+	return data, contentType, nil
+}
+
+func sourceAllowed(scheme string) bool {
+	for _, allowed := range AllowedSources {
+		if strings.EqualFold(scheme, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// data URIs carry the whole image, errors only name the scheme
+func sourceLogURL(rawURL string) string {
+	if len(rawURL) >= 5 && strings.EqualFold(rawURL[:5], "data:") {
+		return "data:"
+	}
+	return rawURL
+}
+
+// size limit every source has to respect, shared with the http fetcher
+func MaxSourceBytes() int64 {
+	return DefaultFetcher.cfg.MaxBytes
+}
+
+// ReadLimited reads at most MaxSourceBytes from r, for use by resolvers.
+func ReadLimited(r io.Reader, rawURL string) ([]byte, error) {
+	limit := MaxSourceBytes()
+	if limit <= 0 {
+		return io.ReadAll(r)
+	}
+	data, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, &FetchError{Reason: FetchFailed, URL: rawURL, Err: err}
+	}
+	if int64(len(data)) > limit {
+		return nil, &FetchError{Reason: FetchTooLarge, URL: rawURL, Err: fmt.Errorf("source exceeds %d bytes", limit)}
+	}
+	return data, nil
+}
+
+func fetchHTTP(ctx context.Context, rawURL string) ([]byte, string, error) {
+	return DefaultFetcher.Fetch(ctx, rawURL)
+}
+
+func readFile(ctx context.Context, rawURL string) ([]byte, string, error) {
+	if FileSourceRoot == "" {
+		return nil, "", &FetchError{Reason: FetchSourceNotAllowed, URL: rawURL, Err: fmt.Errorf("file sources are disabled")}
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, "", &FetchError{Reason: FetchFailed, URL: rawURL, Err: err}
+	}
+	if u.Host != "" && u.Host != "localhost" {
+		return nil, "", &FetchError{Reason: FetchSourceNotAllowed, URL: rawURL, Err: fmt.Errorf("remote file host %q", u.Host)}
+	}
+
+	root, err := filepath.EvalSymlinks(FileSourceRoot)
+	if err != nil {
+		return nil, "", &FetchError{Reason: FetchFailed, URL: rawURL, Err: err}
+	}
+	// resolve links so they can't point outside the root either
+	path, err := filepath.EvalSymlinks(filepath.Join(root, filepath.Clean("/"+u.Path)))
+	if err != nil {
+		return nil, "", &FetchError{Reason: FetchFailed, URL: rawURL, Err: err}
+	}
+	if rel, err := filepath.Rel(root, path); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, "", &FetchError{Reason: FetchSourceNotAllowed, URL: rawURL, Err: fmt.Errorf("path is outside %s", FileSourceRoot)}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, "", &FetchError{Reason: FetchFailed, URL: rawURL, Err: err}
+	}
+	defer f.Close()
+
+	data, err := ReadLimited(f, rawURL)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, mime.TypeByExtension(filepath.Ext(path)), nil
+}
+
+// handles data:[<mediatype>][;base64],<data>
+func decodeDataURI(ctx context.Context, rawURL string) ([]byte, string, error) {
+	meta, payload, ok := strings.Cut(strings.TrimPrefix(rawURL, "data:"), ",")
+	if !ok {
+		return nil, "", &FetchError{Reason: FetchFailed, URL: "data:", Err: fmt.Errorf("malformed data URI")}
+	}
+
+	contentType := meta
+	if strings.HasSuffix(meta, ";base64") {
+		contentType = strings.TrimSuffix(meta, ";base64")
+		data, err := ReadLimited(base64.NewDecoder(base64.StdEncoding, strings.NewReader(payload)), "data:")
+		if err != nil {
+			return nil, "", err
+		}
+		return data, contentType, nil
+	}
+
+	data, err := url.PathUnescape(payload)
+	if err != nil {
+		return nil, "", &FetchError{Reason: FetchFailed, URL: "data:", Err: err}
+	}
+	return []byte(data), contentType, nil
+}
@@ -0,0 +1,36 @@
+package image
+
+import (
+	"context"
+	"encoding/base64"
+	"testing"
+)
+
+func TestOpenSourceChecksAllowedSchemes(t *testing.T) {
+	old := AllowedSources
+	t.Cleanup(func() { AllowedSources = old })
+
+	dataURI := "data:image/png;base64," + base64.StdEncoding.EncodeToString(encodePNG(t, testImage(2, 2)))
+
+	tests := []struct {
+		name    string
+		allowed []string
+		url     string
+		reason  string
+	}{
+		{"data allowed", []string{"http", "https", "data"}, dataURI, ""},
+		{"data allowed any case", []string{"DATA"}, dataURI, ""},
+		{"data disabled", []string{"http", "https", "s3"}, dataURI, FetchSchemeNotAllowed},
+		{"file disabled", []string{"http", "https"}, "file:///etc/passwd", FetchSchemeNotAllowed},
+		{"s3 disabled", []string{"http", "https"}, "s3://bucket/products/1/a.png", FetchSchemeNotAllowed},
+		{"unregistered", []string{"ftp"}, "ftp://example.com/a.png", FetchSchemeNotAllowed},
+		{"missing scheme", []string{"http"}, "example.com/a.png", FetchSchemeNotAllowed},
+	}
+	for _, tt := range tests {
+		AllowedSources = tt.allowed
+		_, _, err := openSource(context.Background(), tt.url)
+		if reason := fetchReason(err); reason != tt.reason {
+			t.Errorf("%s: openSource = %v, want reason %q", tt.name, err, tt.reason)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package services
+
+import (
+	"AsyncProd/config"
+	"AsyncProd/models"
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// everything the collector manages lives under this prefix
+const productsPrefix = "products/"
+
+// outcome of one garbage collection run
+type GCReport struct {
+	DryRun          bool             `json:"dry_run"`
+	Scanned         int              `json:"scanned"`
+	Referenced      int              `json:"referenced"`
+	TooRecent       int              `json:"too_recent"`
+	Orphaned        int              `json:"orphaned"`
+	Deleted         int              `json:"deleted"`
+	ReclaimedBytes  int64            `json:"reclaimed_bytes"`
+	OrphanedObjects []OrphanedObject `json:"orphaned_objects,omitempty"`
+	Errors          []string         `json:"errors,omitempty"`
+}
+
+// an unreferenced object past the grace period
+type OrphanedObject struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+// runs the collector every config.GCInterval until the process exits
+func StartGarbageCollector() {
+	if config.GCInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(config.GCInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		report, err := CollectOrphanedObjects(config.GCDryRun, config.GCGracePeriod)
+		if err != nil {
+			log.Printf("ERROR: Orphaned object collection failed: %v", err)
+			continue
+		}
+		log.Printf("Orphaned object collection: scanned=%d referenced=%d too_recent=%d orphaned=%d deleted=%d reclaimed_bytes=%d dry_run=%t errors=%d",
+			report.Scanned, report.Referenced, report.TooRecent, report.Orphaned, report.Deleted, report.ReclaimedBytes, report.DryRun, len(report.Errors))
+		// lets an operator check what would go before turning dry run off
+		if report.DryRun {
+			for _, obj := range report.OrphanedObjects {
+				log.Printf("Orphaned object (dry run): %s, %d bytes, last modified %s", obj.Key, obj.Size, obj.LastModified.Format(time.RFC3339))
+			}
+		}
+	}
+}
+
+// deletes objects under products/ that no product references and that
+// are older than grace; in dry run mode it only reports them
+func CollectOrphanedObjects(dryRun bool, grace time.Duration) (*GCReport, error) {
+	report := &GCReport{DryRun: dryRun}
+	cutoff := time.Now().Add(-grace)
+
+	ctx := context.Background()
+
+	// list before reading references, so anything referenced meanwhile is kept
+	objects, err := config.Blob.List(ctx, productsPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list objects: %v", err)
+	}
+
+	urls, err := models.GetReferencedImageURLs()
+	if err != nil {
+		return nil, err
+	}
+	referenced := make(map[string]bool, len(urls))
+	for _, u := range urls {
+		if key, ok := objectKeyFromURL(u); ok {
+			referenced[key] = true
+		}
+	}
+
+	for _, obj := range objects {
+		report.Scanned++
+		switch {
+		case referenced[obj.Key]:
+			report.Referenced++
+		case obj.LastModified.After(cutoff):
+			report.TooRecent++
+		case !dryRun && modifiedSince(ctx, obj.Key, cutoff):
+			// a worker reused the object after it was listed
+			report.TooRecent++
+		default:
+			report.Orphaned++
+			report.OrphanedObjects = append(report.OrphanedObjects, OrphanedObject{
+				Key:          obj.Key,
+				Size:         obj.Size,
+				LastModified: obj.LastModified,
+			})
+			if dryRun {
+				report.ReclaimedBytes += obj.Size
+				continue
+			}
+			if err := config.Blob.Delete(ctx, obj.Key); err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("%s: %v", obj.Key, err))
+				continue
+			}
+			report.Deleted++
+			report.ReclaimedBytes += obj.Size
+		}
+	}
+
+	return report, nil
+}
+
+// checks the object again right before deleting it, workers write reused
+// objects again so they show up as modified. Objects that can't be checked
+// are kept.
+func modifiedSince(ctx context.Context, key string, cutoff time.Time) bool {
+	info, err := config.Blob.Head(ctx, key)
+	if err != nil {
+		return true
+	}
+	return info.LastModified.After(cutoff)
+}
@@ -0,0 +1,52 @@
+package services
+
+import (
+	"AsyncProd/config"
+	"AsyncProd/pkg/blobstore"
+	"AsyncProd/pkg/image"
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// registers the image sources that need our own clients
+func RegisterImageSources() {
+	image.RegisterSource("s3", image.SourceResolverFunc(readS3Source))
+}
+
+// handles s3://bucket/key, only our configured bucket can be read and
+// the object is read through the configured storage backend
+func readS3Source(ctx context.Context, rawURL string) ([]byte, string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, "", &image.FetchError{Reason: image.FetchFailed, URL: rawURL, Err: err}
+	}
+	if u.Host != config.S3Bucket {
+		return nil, "", &image.FetchError{Reason: image.FetchSourceNotAllowed, URL: rawURL, Err: fmt.Errorf("bucket %q is not allowed", u.Host)}
+	}
+
+	body, info, err := config.Blob.Get(ctx, strings.TrimPrefix(u.Path, "/"))
+	if err != nil {
+		if errors.Is(err, blobstore.ErrNotFound) {
+			return nil, "", &image.FetchError{Reason: image.FetchBadStatus, URL: rawURL, Err: err}
+		}
+		return nil, "", &image.FetchError{Reason: image.FetchFailed, URL: rawURL, Err: err}
+	}
+	defer body.Close()
+
+	if limit := image.MaxSourceBytes(); limit > 0 && info.Size > limit {
+		return nil, "", &image.FetchError{Reason: image.FetchTooLarge, URL: rawURL, Err: fmt.Errorf("object exceeds %d bytes", limit)}
+	}
+	data, err := image.ReadLimited(body, rawURL)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, info.ContentType, nil
+}
+
+// the s3:// URL an object in our bucket is referenced by
+func objectSourceURL(key string) string {
+	return fmt.Sprintf("s3://%s/%s", config.S3Bucket, key)
+}
@@ -0,0 +1,104 @@
+package services
+
+import (
+	"AsyncProd/config"
+	"AsyncProd/models"
+	"AsyncProd/pkg/blobstore"
+	"context"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// what gets stored in the product for an uploaded object, just the key
+// in private mode and the public URL otherwise
+func storedImageRef(key string) string {
+	if config.StoragePrivate {
+		return key
+	}
+	return config.Blob.URL(key)
+}
+
+// maps a stored image reference back to its key in our storage
+func objectKeyFromURL(rawURL string) (string, bool) {
+	if !strings.Contains(rawURL, "://") {
+		// a bare key stored in private mode
+		return rawURL, strings.HasPrefix(rawURL, productsPrefix)
+	}
+
+	bases := []string{config.Blob.URL("")}
+	for _, alias := range config.StorageURLAliases {
+		bases = append(bases, strings.TrimSuffix(alias, "/")+"/")
+	}
+	for _, base := range bases {
+		if strings.HasPrefix(rawURL, base) {
+			key, err := url.PathUnescape(strings.TrimPrefix(rawURL, base))
+			return key, err == nil
+		}
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", false
+	}
+	if u.Scheme == "s3" && u.Host == config.S3Bucket {
+		return strings.TrimPrefix(u.Path, "/"), true
+	}
+	return "", false
+}
+
+// swaps stored compressed image references for URLs clients can load,
+// in private mode those are short-lived presigned URLs
+func PresentProduct(ctx context.Context, product *models.Product) {
+	if !config.StoragePrivate {
+		return
+	}
+	for name, refs := range product.CompressedImages {
+		urls := make([]string, len(refs))
+		for i, ref := range refs {
+			urls[i] = signedImageURL(ctx, ref)
+		}
+		product.CompressedImages[name] = urls
+	}
+}
+
+func signedImageURL(ctx context.Context, ref string) string {
+	key, ok := objectKeyFromURL(ref)
+	if !ok {
+		return ref
+	}
+	presigner, ok := config.Blob.(blobstore.Presigner)
+	if !ok {
+		return config.Blob.URL(key)
+	}
+
+	cacheKey := "signed_url:" + key
+	if config.SignedURLCaching {
+		if cached, err := config.RedisClient.Get(ctx, cacheKey).Result(); err == nil {
+			return cached
+		} else if err != redis.Nil {
+			log.Printf("WARNING: Failed to read signed URL cache for %s: %v", key, err)
+		}
+	}
+
+	signed, err := presigner.PresignGet(key, config.SignedURLExpiry)
+	if err != nil {
+		log.Printf("ERROR: Failed to presign %s: %v", key, err)
+		return ""
+	}
+
+	if config.SignedURLCaching {
+		// hand out cached URLs only while they still have half their lifetime left
+		ttl := config.SignedURLExpiry / 2
+		if ttl > time.Second {
+			if err := config.RedisClient.Set(ctx, cacheKey, signed, ttl).Err(); err != nil {
+				log.Printf("WARNING: Failed to cache signed URL for %s: %v", key, err)
+			}
+		}
+	}
+
+	return signed
+}
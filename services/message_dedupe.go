@@ -0,0 +1,131 @@
+package services
+
+import (
+	"AsyncProd/config"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/streadway/amqp"
+)
+
+// values of a message's dedupe key
+const (
+	claimProcessing = "processing"
+	claimDone       = "done"
+)
+
+// outcome of claiming a message before processing it
+type claimResult int
+
+const (
+	// this worker owns the message now
+	claimAcquired claimResult = iota
+	// the message was completed before, it's a redelivery or duplicate
+	claimCompleted
+	// another worker is processing the same message right now
+	claimBusy
+	// Redis is unavailable, the message is processed without dedupe
+	claimSkipped
+)
+
+func contentHash(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// dedupe key of a message, by message ID or by content for messages
+// published without one
+func messageClaimKey(msg amqp.Delivery) string {
+	if msg.MessageId != "" {
+		return "image_message:" + msg.MessageId
+	}
+	return "image_message:sha256:" + contentHash(msg.Body)
+}
+
+// reports a body that doesn't match the hash it was published with
+func contentHashMismatch(msg amqp.Delivery) bool {
+	published, ok := msg.Headers[headerContentHash].(string)
+	return ok && published != contentHash(msg.Body)
+}
+
+// claims the message with SETNX, the claim expires after
+// config.MessageClaimTTL so a crashed worker doesn't block it forever
+func claimMessage(key string) claimResult {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ok, err := config.RedisClient.SetNX(ctx, key, claimProcessing, config.MessageClaimTTL).Result()
+	if err != nil {
+		log.Printf("WARNING: Failed to claim message %s, processing without dedupe: %v", key, err)
+		return claimSkipped
+	}
+	if ok {
+		return claimAcquired
+	}
+
+	state, err := config.RedisClient.Get(ctx, key).Result()
+	switch {
+	case err == redis.Nil:
+		// the claim expired in between, try once more
+		ok, err = config.RedisClient.SetNX(ctx, key, claimProcessing, config.MessageClaimTTL).Result()
+		if err == nil && ok {
+			return claimAcquired
+		}
+		return claimBusy
+	case err != nil:
+		log.Printf("WARNING: Failed to read claim of message %s, processing without dedupe: %v", key, err)
+		return claimSkipped
+	case state == claimDone:
+		return claimCompleted
+	default:
+		return claimBusy
+	}
+}
+
+// keeps extending the claim while the message is processed, so a job that
+// runs longer than config.MessageClaimTTL isn't picked up a second time.
+// Call the returned func when done.
+func holdClaim(key string) func() {
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(config.MessageClaimTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				err := config.RedisClient.Expire(ctx, key, config.MessageClaimTTL).Err()
+				cancel()
+				if err != nil {
+					log.Printf("WARNING: Failed to extend claim of message %s: %v", key, err)
+				}
+			}
+		}
+	}()
+	return func() { close(stop) }
+}
+
+// remembers the message as completed for config.MessageDoneTTL
+func completeMessage(key string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := config.RedisClient.Set(ctx, key, claimDone, config.MessageDoneTTL).Err(); err != nil {
+		log.Printf("WARNING: Failed to mark message %s completed: %v", key, err)
+	}
+}
+
+// drops the claim so a retry or a replay from the dead letter queue can
+// take the message again
+func releaseMessage(key string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := config.RedisClient.Del(ctx, key).Err(); err != nil {
+		log.Printf("WARNING: Failed to release message %s: %v", key, err)
+	}
+}
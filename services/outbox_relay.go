@@ -0,0 +1,68 @@
+package services
+
+import (
+	"AsyncProd/config"
+	"AsyncProd/models"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// publishes outbox messages until the process exits. A message is marked
+// sent only after the broker confirmed it, so delivery is at least once
+// and the worker may see a job twice.
+func StartOutboxRelay() {
+	ticker := time.NewTicker(config.OutboxPollInterval)
+	defer ticker.Stop()
+	lastCleanup := time.Now()
+
+	for range ticker.C {
+		// drain the backlog in batches before waiting for the next tick
+		for {
+			sent, failed, err := models.RelayOutbox(config.OutboxBatchSize, publishOutboxMessage)
+			if err != nil {
+				log.Printf("ERROR: Outbox relay stopped after %d messages: %v", sent, err)
+				break
+			}
+			if sent > 0 {
+				log.Printf("SUCCESS: Relayed %d outbox messages", sent)
+			}
+			if failed > 0 {
+				log.Printf("WARNING: Failed to relay %d outbox messages", failed)
+			}
+			// failed rows wait for their next attempt, so they don't come
+			// back in the next batch
+			if sent+failed < config.OutboxBatchSize {
+				break
+			}
+		}
+
+		if config.OutboxRetention > 0 && time.Since(lastCleanup) >= time.Hour {
+			lastCleanup = time.Now()
+			deleted, err := models.DeleteSentOutboxMessages(time.Now().Add(-config.OutboxRetention))
+			if err != nil {
+				log.Printf("ERROR: %v", err)
+			} else if deleted > 0 {
+				log.Printf("Deleted %d sent outbox messages", deleted)
+			}
+		}
+	}
+}
+
+func publishOutboxMessage(msg models.OutboxMessage) error {
+	err := publishConfirmed(msg.Queue, amqp.Publishing{
+		ContentType: "application/json",
+		MessageId:   msg.MessageID,
+		Headers:     amqp.Table{headerContentHash: contentHash(msg.Payload)},
+		Body:        msg.Payload,
+	})
+	// while disconnected every message fails the same way, that's not
+	// counted against them
+	if errors.Is(err, ErrPublisherClosed) {
+		return fmt.Errorf("%w: %v", models.ErrOutboxUnavailable, err)
+	}
+	return err
+}
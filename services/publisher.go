@@ -0,0 +1,192 @@
+package services
+
+import (
+	"AsyncProd/config"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+var (
+	ErrPublishNacked     = errors.New("broker rejected the message")
+	ErrPublishUnroutable = errors.New("message was not routed to any queue")
+	ErrPublishTimeout    = errors.New("timed out waiting for broker confirmation")
+	ErrPublisherClosed   = errors.New("not connected to RabbitMQ")
+)
+
+// confirmedPublisher publishes on a channel in confirm mode and waits for
+// the broker's ack of each message. Confirms carry the channel's delivery
+// tag, returns the message ID, that's how both are matched to a publish.
+type confirmedPublisher struct {
+	mu       sync.Mutex
+	ch       *amqp.Channel
+	seq      uint64
+	pending  map[uint64]*pendingPublish
+	returned map[string]bool
+	// message IDs of publishes that timed out, by tag, their late confirm
+	// still has to clear a late return
+	timedOut map[uint64]string
+	closed   bool
+}
+
+type pendingPublish struct {
+	messageID string
+	done      chan error
+}
+
+var (
+	publisherMu sync.RWMutex
+	publisher   *confirmedPublisher
+)
+
+// publishes on config's publishing channel, and on the new one after
+// every reconnect. Has to run after InitRabbitMQ.
+func StartPublisher() {
+	config.OnRabbitMQConnect(func(conn *amqp.Connection, ch *amqp.Channel) {
+		p := newConfirmedPublisher(ch)
+		publisherMu.Lock()
+		publisher = p
+		publisherMu.Unlock()
+	})
+}
+
+func newConfirmedPublisher(ch *amqp.Channel) *confirmedPublisher {
+	p := &confirmedPublisher{
+		ch:       ch,
+		pending:  make(map[uint64]*pendingPublish),
+		returned: make(map[string]bool),
+		timedOut: make(map[uint64]string),
+	}
+	// returns are unbuffered so a message's return is always handled
+	// before its ack, the library sends both from the same goroutine
+	returns := ch.NotifyReturn(make(chan amqp.Return))
+	confirms := ch.NotifyPublish(make(chan amqp.Confirmation, 64))
+	go p.listen(returns, confirms)
+	return p
+}
+
+// publishes on the current channel, fails fast while disconnected
+// instead of waiting for the reconnect
+func publishConfirmed(queue string, msg amqp.Publishing) error {
+	publisherMu.RLock()
+	p := publisher
+	publisherMu.RUnlock()
+	if p == nil {
+		return ErrPublisherClosed
+	}
+	return p.publish(queue, msg)
+}
+
+func (p *confirmedPublisher) listen(returns <-chan amqp.Return, confirms <-chan amqp.Confirmation) {
+	for {
+		select {
+		case ret, ok := <-returns:
+			if !ok {
+				returns = nil
+				continue
+			}
+			log.Printf("WARNING: Message %s returned by broker: %d %s", ret.MessageId, ret.ReplyCode, ret.ReplyText)
+			p.mu.Lock()
+			p.returned[ret.MessageId] = true
+			p.mu.Unlock()
+		case confirm, ok := <-confirms:
+			if !ok {
+				p.close()
+				return
+			}
+			p.resolve(confirm)
+		}
+	}
+}
+
+func (p *confirmedPublisher) resolve(confirm amqp.Confirmation) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pending, ok := p.pending[confirm.DeliveryTag]
+	if !ok {
+		// nobody waits for it anymore, but a return that came with it would
+		// fail the next publish of the same message
+		if id, ok := p.timedOut[confirm.DeliveryTag]; ok {
+			delete(p.timedOut, confirm.DeliveryTag)
+			delete(p.returned, id)
+		}
+		return
+	}
+	delete(p.pending, confirm.DeliveryTag)
+
+	var err error
+	switch {
+	case !confirm.Ack:
+		err = ErrPublishNacked
+	case p.returned[pending.messageID]:
+		err = ErrPublishUnroutable
+	}
+	delete(p.returned, pending.messageID)
+	pending.done <- err
+}
+
+// fails every publish still waiting, the channel won't confirm them anymore
+func (p *confirmedPublisher) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for tag, pending := range p.pending {
+		pending.done <- ErrPublisherClosed
+		delete(p.pending, tag)
+	}
+	p.timedOut = make(map[uint64]string)
+}
+
+// publishes msg as persistent and mandatory and waits up to
+// config.PublishConfirmTimeout for the broker to take it
+func (p *confirmedPublisher) publish(queue string, msg amqp.Publishing) error {
+	if msg.MessageId == "" {
+		id, err := randomName()
+		if err != nil {
+			return err
+		}
+		msg.MessageId = id
+	}
+	msg.DeliveryMode = amqp.Persistent
+	done := make(chan error, 1)
+
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return ErrPublisherClosed
+	}
+	// tags count publishes on the channel, so the publish has to happen
+	// under the same lock that hands out the tag
+	err := p.ch.Publish("", queue, true, false, msg)
+	if err != nil {
+		p.mu.Unlock()
+		if errors.Is(err, amqp.ErrClosed) {
+			return ErrPublisherClosed
+		}
+		return err
+	}
+	p.seq++
+	tag := p.seq
+	p.pending[tag] = &pendingPublish{messageID: msg.MessageId, done: done}
+	p.mu.Unlock()
+
+	timer := time.NewTimer(config.PublishConfirmTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		p.mu.Lock()
+		if _, ok := p.pending[tag]; ok {
+			delete(p.pending, tag)
+			p.timedOut[tag] = msg.MessageId
+		}
+		delete(p.returned, msg.MessageId)
+		p.mu.Unlock()
+		return fmt.Errorf("%w after %s", ErrPublishTimeout, config.PublishConfirmTimeout)
+	}
+}
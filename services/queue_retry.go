@@ -0,0 +1,118 @@
+package services
+
+import (
+	"AsyncProd/config"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// headers carried by retried and dead lettered messages
+const (
+	headerAttempts       = "x-attempts"
+	headerLastError      = "x-last-error"
+	headerLastReason     = "x-last-error-reason"
+	headerDeadLetteredAt = "x-dead-lettered-at"
+	// hex SHA-256 of the body, set by the publisher
+	headerContentHash = "x-content-hash"
+)
+
+// failure reasons recorded on retried and dead lettered messages
+const (
+	reasonInvalidMessage   = "invalid_message"
+	reasonProcessingFailed = "processing_failed"
+	reasonUpdateFailed     = "update_failed"
+	reasonImagesFailed     = "images_failed"
+)
+
+// number of failed deliveries so far, 0 for a fresh message
+func deliveryAttempts(msg amqp.Delivery) int {
+	switch n := msg.Headers[headerAttempts].(type) {
+	case int32:
+		return int(n)
+	case int64:
+		return int(n)
+	case int:
+		return n
+	}
+	return 0
+}
+
+// schedules the message for another try through a delay queue, or moves
+// it to the dead letter queue once it is out of attempts, which is
+// reported. The original delivery is acked only after the broker confirmed
+// the copy, otherwise it's requeued.
+func retryOrDeadLetter(msg amqp.Delivery, reason string, cause error) bool {
+	attempts := deliveryAttempts(msg) + 1
+	if attempts >= config.MaxDeliveryAttempts {
+		log.Printf("ERROR: Giving up on message after %d attempts: %v", attempts, cause)
+		return deadLetter(msg, attempts, reason, cause)
+	}
+
+	delay := config.RetryDelay(attempts)
+	err := republish(config.RetryQueueName(delay), msg, retryHeaders(msg, attempts, reason, cause))
+	if err != nil {
+		log.Printf("ERROR: Failed to schedule retry, requeueing: %v", err)
+		msg.Nack(false, true)
+		return false
+	}
+	log.Printf("Retrying message in %s (attempt %d of %d)", delay, attempts+1, config.MaxDeliveryAttempts)
+	msg.Ack(false)
+	return false
+}
+
+// puts the message back after delay without counting an attempt, for
+// messages that couldn't be started rather than failed
+func deferMessage(msg amqp.Delivery, delay time.Duration) {
+	headers := amqp.Table{}
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	err := republish(config.RetryQueueName(delay), msg, headers)
+	if err != nil {
+		log.Printf("ERROR: Failed to defer message, requeueing: %v", err)
+		msg.Nack(false, true)
+		return
+	}
+	msg.Ack(false)
+}
+
+// moves the message to the dead letter queue with its last error, reports
+// false when it was requeued instead
+func deadLetter(msg amqp.Delivery, attempts int, reason string, cause error) bool {
+	headers := retryHeaders(msg, attempts, reason, cause)
+	headers[headerDeadLetteredAt] = time.Now().UTC().Format(time.RFC3339)
+
+	err := republish(config.ImageDeadLetterQueue, msg, headers)
+	if err != nil {
+		log.Printf("ERROR: Failed to dead letter message, requeueing: %v", err)
+		msg.Nack(false, true)
+		return false
+	}
+	msg.Ack(false)
+	return true
+}
+
+func retryHeaders(msg amqp.Delivery, attempts int, reason string, cause error) amqp.Table {
+	headers := amqp.Table{}
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	headers[headerAttempts] = int32(attempts)
+	headers[headerLastReason] = reason
+	headers[headerLastError] = fmt.Sprint(cause)
+	return headers
+}
+
+// publishes the copy through the confirmed publisher, so it's persistent,
+// mandatory and acked by the broker before the original is acked
+func republish(queue string, msg amqp.Delivery, headers amqp.Table) error {
+	return publishConfirmed(queue, amqp.Publishing{
+		ContentType: msg.ContentType,
+		MessageId:   msg.MessageId,
+		Headers:     headers,
+		Body:        msg.Body,
+	})
+}
@@ -3,16 +3,19 @@ package services
 import (
 	"AsyncProd/config"
 	"AsyncProd/models"
+	"AsyncProd/pkg/blobstore"
 	"AsyncProd/pkg/image"
-	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
-	"path/filepath"
+	"strconv"
+	"sync"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/streadway/amqp"
 )
 
@@ -20,134 +23,400 @@ type ImageProcessingMessage struct {
 	ProductID     int      `json:"product_id"`
 	UserID        int      `json:"user_id"`
 	ImageURLs     []string `json:"image_urls"`
+	// job tracking this run, 0 for messages queued before jobs existed
+	JobID int64 `json:"job_id,omitempty"`
 }
 
-//sends image processing msgg to RabbitMQ
-func PublishImageProcessingMessage(productID, userID int, imageURLs []string) error {
+// builds the image processing job for a product, it's written to the
+// outbox with the product and published by the outbox relay
+func ImageProcessingOutbox(product *models.Product, job *models.ProcessingJob) (*models.OutboxMessage, error) {
 	message := ImageProcessingMessage{
-		ProductID: productID,
-		UserID:    userID,
-		ImageURLs: imageURLs,
+		ProductID: product.ID,
+		UserID:    product.UserID,
+		ImageURLs: product.ProductImages,
+		JobID:     job.ID,
 	}
 
 	//Convert msg to JSON
 	body, err := json.Marshal(message)
 	if err != nil {
-		return fmt.Errorf("failed to marshal message: %v", err)
-	}
-
-	//Publish to RabbitMQ
-	err = config.RabbitMQChannel.Publish(
-		"",                            
-		config.ImageProcessingQueue,   
-		false,                         
-		false,                         
-		amqp.Publishing{
-			ContentType: "application/json",
-			Body:        body,
-		},
-	)
+		return nil, fmt.Errorf("failed to marshal message: %v", err)
+	}
 
+	messageID, err := randomName()
 	if err != nil {
-		return fmt.Errorf("failed to publish message: %v", err)
+		return nil, err
 	}
 
-	return nil
+	return &models.OutboxMessage{MessageID: messageID, Queue: config.ImageProcessingQueue, Payload: body}, nil
 }
 
-// consumes msgs from RabbitMQ and processes images
+// consumes msgs from RabbitMQ and processes images, with
+// config.ConsumerCount consumers each on its own channel. The consumers
+// are started again on every new connection.
 func ProcessImageFromQueue() {
-	msgs, err := config.RabbitMQChannel.Consume(
-		config.ImageProcessingQueue, 
-		"",                          
-		false,                       
-		false,                       
-		false,                       
-		false,                       
-		nil,                       
+	config.OnRabbitMQConnect(func(conn *amqp.Connection, _ *amqp.Channel) {
+		for i := 0; i < config.ConsumerCount; i++ {
+			go runConsumer(conn, fmt.Sprintf("image-worker-%d", i))
+		}
+	})
+
+	forever := make(chan bool)
+
+	log.Printf(" [*] %d consumers waiting for messages (prefetch %d). To exit press CTRL+C", config.ConsumerCount, config.Prefetch)
+	<-forever
+}
+
+// consumes on conn until it closes, reopening the channel if only that
+// was closed by the broker
+func runConsumer(conn *amqp.Connection, tag string) {
+	for !conn.IsClosed() {
+		ch, msgs, err := openConsumer(conn, tag)
+		if err != nil {
+			log.Printf("ERROR: Failed to register consumer %s: %v", tag, err)
+		} else {
+			consumeImageMessages(msgs)
+			ch.Close()
+		}
+		time.Sleep(config.ReconnectMinDelay)
+	}
+	log.Printf("Consumer %s stopped, waiting for RabbitMQ to reconnect", tag)
+}
+
+// opens a channel with the configured prefetch and consumes the image queue on it
+func openConsumer(conn *amqp.Connection, tag string) (*amqp.Channel, <-chan amqp.Delivery, error) {
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open a channel: %v", err)
+	}
+	err = ch.Qos(config.Prefetch, 0, false)
+	if err != nil {
+		ch.Close()
+		return nil, nil, fmt.Errorf("failed to set prefetch: %v", err)
+	}
+	msgs, err := ch.Consume(
+		config.ImageProcessingQueue, // queue
+		tag,                         // consumer
+		false,                       // auto-ack
+		false,                       // exclusive
+		false,                       // no-local
+		false,                       // no-wait
+		nil,                         // args
 	)
 	if err != nil {
-		log.Fatalf("Failed to register a consumer: %v", err)
+		ch.Close()
+		return nil, nil, err
 	}
+	return ch, msgs, nil
+}
 
-	forever := make(chan bool)
+// Every message is claimed in Redis first, so a redelivered or duplicate
+// message is skipped once it was completed.
+func consumeImageMessages(msgs <-chan amqp.Delivery) {
+	for msg := range msgs {
+		// retrying won't fix a broken message, its job is dead right away
+		if contentHashMismatch(msg) {
+			log.Printf("Error verifying message %s: content hash mismatch", msg.MessageId)
+			cause := errors.New("content hash mismatch")
+			dead := deadLetter(msg, deliveryAttempts(msg)+1, reasonInvalidMessage, cause)
+			failJobAttempt(messageJobID(msg.Body), dead, cause)
+			continue
+		}
 
-	go func() {
-		for msg := range msgs {
-			var processMsg ImageProcessingMessage
-			err := json.Unmarshal(msg.Body, &processMsg)
-			if err != nil {
-				log.Printf("Error parsing message: %v", err)
-				msg.Reject(false)
-				continue
-			}
+		var processMsg ImageProcessingMessage
+		err := json.Unmarshal(msg.Body, &processMsg)
+		if err != nil {
+			log.Printf("Error parsing message: %v", err)
+			dead := deadLetter(msg, deliveryAttempts(msg)+1, reasonInvalidMessage, err)
+			failJobAttempt(messageJobID(msg.Body), dead, err)
+			continue
+		}
 
-			compressedImages, err := processImagesForProduct(processMsg)
-			if err != nil {
-				log.Printf("Error processing images: %v", err)
-				msg.Reject(true) //requeue
-				continue
-			}
-			err = updateProductCompressedImages(processMsg.ProductID, compressedImages)
-			if err != nil {
-				log.Printf("Error updating product: %v", err)
-				msg.Reject(true)
-				continue
-			}
+		key := messageClaimKey(msg)
+		claim := claimMessage(key)
+		switch claim {
+		case claimCompleted:
+			log.Printf("Skipping message %s for product ID %d, already processed", key, processMsg.ProductID)
 			msg.Ack(false)
+			continue
+		case claimBusy:
+			// check back once the claim could have run out. That's not a
+			// failed attempt, a worker that crashed mid-job leaves its claim
+			// behind and this copy has to pick the job up after it expired.
+			log.Printf("Message %s for product ID %d is being processed by another worker, deferring it by %s", key, processMsg.ProductID, config.MessageClaimTTL)
+			deferMessage(msg, config.MessageClaimTTL)
+			continue
 		}
-	}()
 
-	log.Printf(" [*] Waiting for messages. To exit press CTRL+C")
-	<-forever
+		stopHeartbeat := func() {}
+		if claim == claimAcquired {
+			stopHeartbeat = holdClaim(key)
+		}
+		completed := handleImageMessage(msg, processMsg)
+		stopHeartbeat()
+		if claim == claimAcquired {
+			if completed {
+				completeMessage(key)
+			} else {
+				releaseMessage(key)
+			}
+		}
+	}
 }
 
-func processImagesForProduct(msg ImageProcessingMessage) ([]string, error) {
-	var compressedImageURLs []string
+// processes one claimed message, reports whether it was completed or
+// handed on for a retry or to the dead letter queue
+func handleImageMessage(msg amqp.Delivery, processMsg ImageProcessingMessage) bool {
+	job := processMsg.JobID
+	trackJob(job, func() error { return models.StartProcessingJob(job, deliveryAttempts(msg)+1) })
+
+	compressedImages, records, err := processImagesForProduct(processMsg)
+	if err != nil {
+		log.Printf("Error processing images: %v", err)
+		failJobAttempt(job, retryOrDeadLetter(msg, reasonProcessingFailed, err), err)
+		return false
+	}
+	outcome := jobOutcome(records)
+	policy := failurePolicy(outcome, records)
 
-	for _, imgURL := range msg.ImageURLs {
-		log.Printf("Processing image: %s", imgURL)
-		compressedImg, err := image.CompressImage(imgURL)
+	// a retry that stored nothing would only replace the product's current
+	// renditions with none, until the last attempt it's recorded on the job
+	// alone
+	lastAttempt := deliveryAttempts(msg)+1 >= config.MaxDeliveryAttempts
+	if policy != config.FailurePolicyRetry || storedOutputs(records) > 0 || lastAttempt {
+		err = updateProductCompressedImages(processMsg.ProductID, job, compressedImages, records)
+		if errors.Is(err, models.ErrJobSuperseded) {
+			// a newer job owns the product now, retrying can't change that
+			log.Printf("Skipping results of job %d for product ID %d: %v", job, processMsg.ProductID, err)
+			msg.Ack(false)
+			trackJob(job, func() error { return models.FinishProcessingJob(job, outcome, records, err.Error()) })
+			return true
+		}
 		if err != nil {
-			log.Printf("ERROR: Failed to compress image %s: %v", imgURL, err)
-			continue
+			log.Printf("Error updating product: %v", err)
+			failJobAttempt(job, retryOrDeadLetter(msg, reasonUpdateFailed, err), err)
+			return false
 		}
-		log.Printf("SUCCESS: Compressed image %s", imgURL)
-
-		s3Key := fmt.Sprintf("products/%d/%s", msg.ProductID, generateUniqueFileName(imgURL))
-		log.Printf("Generated S3 key for image %s: %s", imgURL, s3Key)
-		log.Printf("Uploading image %s to S3 bucket: %s with key: %s", imgURL, config.S3Bucket, s3Key)
-		_, err = config.S3Client.PutObject(&s3.PutObjectInput{
-			Bucket: aws.String(config.S3Bucket),
-			Key:    aws.String(s3Key),
-			Body:   aws.ReadSeekCloser(bytes.NewReader(compressedImg)),
+	}
+
+	switch policy {
+	case config.FailurePolicyRetry:
+		cause := fmt.Errorf("%d of %d images failed", failedImages(records), len(records))
+		log.Printf("Retrying product ID %d: %v", processMsg.ProductID, cause)
+		dead := retryOrDeadLetter(msg, reasonImagesFailed, cause)
+		trackJob(job, func() error {
+			if dead {
+				return models.FinishProcessingJob(job, models.JobDead, records, cause.Error())
+			}
+			return models.RetryProcessingJob(job, records, cause.Error())
 		})
-		if err != nil {
-			log.Printf("ERROR: Failed to upload image %s to S3: %v", imgURL, err)
-			continue
+		return false
+	case config.FailurePolicyFail:
+		msg.Ack(false)
+		cause := fmt.Sprintf("%d of %d images failed", failedImages(records), len(records))
+		trackJob(job, func() error { return models.FinishProcessingJob(job, models.JobFailed, records, cause) })
+	default:
+		msg.Ack(false)
+		trackJob(job, func() error { return models.FinishProcessingJob(job, outcome, records, "") })
+	}
+	return true
+}
+
+// processes the message's images with at most config.ImageParallelism
+// in flight, results keep the order of msg.ImageURLs
+func processImagesForProduct(msg ImageProcessingMessage) (models.RenditionURLs, models.ImageRecords, error) {
+	records := make(models.ImageRecords, len(msg.ImageURLs))
+	uploaded := make([]map[string]string, len(msg.ImageURLs))
+
+	parallelism := max(config.ImageParallelism, 1)
+	sem := make(chan struct{}, parallelism)
+	var wg sync.WaitGroup
+
+	for i, imgURL := range msg.ImageURLs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, imgURL string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			records[i], uploaded[i] = processImage(msg.ProductID, imgURL)
+		}(i, imgURL)
+	}
+	wg.Wait()
+
+	// one slot per source image in every list, "" where an output is
+	// missing, so index i of each rendition is the same photo
+	compressedImageURLs := make(models.RenditionURLs, len(image.Renditions))
+	for _, rendition := range image.Renditions {
+		urls := make([]string, len(uploaded))
+		for i, renditions := range uploaded {
+			urls[i] = renditions[rendition.Name]
 		}
-		log.Printf("SUCCESS: Uploaded image %s to S3: %s", imgURL, s3Key)
-		compressedURL := fmt.Sprintf("https://%s.s3.amazonaws.com/%s", config.S3Bucket, s3Key)
-		log.Printf("Generated public URL for image %s: %s", imgURL, compressedURL)
-		compressedImageURLs = append(compressedImageURLs, compressedURL)
+		compressedImageURLs[rendition.Name] = urls
 	}
 
-	if len(compressedImageURLs) == 0 {
+	if storedOutputs(records) == 0 {
 		log.Printf("WARNING: No images were successfully processed for product ID: %d", msg.ProductID)
 	}
 
-	return compressedImageURLs, nil
+	return compressedImageURLs, records, nil
 }
 
-// updates product with compressed image URLs
-func updateProductCompressedImages(productID int, compressedImages []string) error {
-	product, err := models.GetProductByID(productID)
+// compresses one image and uploads its renditions, returns the record
+// and the URL of every rendition that made it to storage
+func processImage(productID int, imgURL string) (models.ImageRecord, map[string]string) {
+	log.Printf("Processing image: %s", imgURL)
+	record := models.ImageRecord{SourceURL: imgURL, Status: models.ImageFailed}
+	uploaded := make(map[string]string)
+
+	result, err := image.CompressImage(imgURL, image.Renditions)
 	if err != nil {
-		return fmt.Errorf("failed to retrieve product: %v", err)
+		log.Printf("ERROR: Failed to compress image %s: %v", imgURL, err)
+		record.Error = err.Error()
+		record.ErrorReason = imageErrorReason(err)
+		return record, uploaded
 	}
+	log.Printf("SUCCESS: Compressed image %s into %d renditions", imgURL, len(result.Renditions))
+	record.SourceFormat = result.SourceFormat
+	record.SourceWidth = result.SourceWidth
+	record.SourceHeight = result.SourceHeight
+	record.SourceBytes = result.SourceBytes
+	record.MetadataRemoved = result.Metadata.Removed
+	record.MetadataKept = result.Metadata.Kept
 
-	product.CompressedImages = compressedImages
-	err = models.UpdateProduct(product)
+	for _, rendition := range result.Renditions {
+		key := renditionKey(productID, rendition)
+		err = uploadIfMissing(key, rendition.Data, renditionPutOptions(productID, imgURL, rendition))
+		if err != nil {
+			log.Printf("ERROR: Failed to upload %s rendition of image %s: %v", rendition.Rendition, imgURL, err)
+			record.Error = fmt.Sprintf("failed to upload %s rendition: %v", rendition.Rendition, err)
+			record.ErrorReason = "upload_failed"
+			continue
+		}
+		compressedURL := storedImageRef(key)
+		log.Printf("SUCCESS: Stored %s rendition of image %s: %s", rendition.Rendition, imgURL, compressedURL)
+		uploaded[rendition.Rendition] = compressedURL
+		record.Outputs = append(record.Outputs, models.ImageOutput{
+			Rendition: rendition.Rendition,
+			Key:       key,
+			Format:    rendition.Format,
+			Width:     rendition.Width,
+			Height:    rendition.Height,
+			Bytes:     len(rendition.Data),
+		})
+	}
+
+	switch len(record.Outputs) {
+	case len(result.Renditions):
+		record.Status = models.ImageSucceeded
+	case 0:
+		record.Status = models.ImageFailed
+	default:
+		record.Status = models.ImagePartial
+	}
+	return record, uploaded
+}
+
+// job updates are bookkeeping, a failed one is logged and the message
+// handled as usual
+func trackJob(jobID int64, update func() error) {
+	if jobID == 0 {
+		return
+	}
+	if err := update(); err != nil {
+		log.Printf("WARNING: Failed to update processing job %d: %v", jobID, err)
+	}
+}
+
+// job ID of a message that can't be processed, as far as it can be read
+func messageJobID(body []byte) int64 {
+	var msg struct {
+		JobID int64 `json:"job_id"`
+	}
+	if err := json.Unmarshal(body, &msg); err != nil {
+		return 0
+	}
+	return msg.JobID
+}
+
+// records a failed attempt, dead jobs are final
+func failJobAttempt(jobID int64, dead bool, cause error) {
+	trackJob(jobID, func() error {
+		if dead {
+			return models.FinishProcessingJob(jobID, models.JobDead, nil, cause.Error())
+		}
+		return models.RetryProcessingJob(jobID, nil, cause.Error())
+	})
+}
+
+// final state of a job from its per-image records
+func jobOutcome(records models.ImageRecords) string {
+	failed := failedImages(records)
+	switch {
+	case failed == 0:
+		return models.JobSucceeded
+	case failed < len(records):
+		return models.JobPartial
+	default:
+		return models.JobFailed
+	}
+}
+
+// images that didn't get all of their renditions stored
+func failedImages(records models.ImageRecords) int {
+	failed := 0
+	for _, record := range records {
+		if record.Status != models.ImageSucceeded {
+			failed++
+		}
+	}
+	return failed
+}
+
+// renditions that made it to storage across all images
+func storedOutputs(records models.ImageRecords) int {
+	stored := 0
+	for _, record := range records {
+		stored += len(record.Outputs)
+	}
+	return stored
+}
+
+// failure reasons another attempt may get past
+var retryableImageErrors = map[string]bool{
+	image.FetchTimeout:   true,
+	image.FetchBadStatus: true,
+	image.FetchFailed:    true,
+	"upload_failed":      true,
+}
+
+// applies the configured policy to the outcome. A retry is only worth it
+// when one of the failures is transient, a job of broken or blocked
+// images fails right away.
+func failurePolicy(outcome string, records models.ImageRecords) string {
+	policy := config.FailurePolicySuccess
+	switch outcome {
+	case models.JobPartial:
+		policy = config.PartialFailurePolicy
+	case models.JobFailed:
+		policy = config.TotalFailurePolicy
+	}
+	if policy != config.FailurePolicyRetry {
+		return policy
+	}
+	for _, record := range records {
+		if record.Status != models.ImageSucceeded && retryableImageErrors[record.ErrorReason] {
+			return config.FailurePolicyRetry
+		}
+	}
+	return config.FailurePolicyFail
+}
+
+// updates product with compressed image URLs
+func updateProductCompressedImages(productID int, jobID int64, compressedImages models.RenditionURLs, records models.ImageRecords) error {
+	err := models.SetProcessedImages(productID, jobID, compressedImages, records)
+	if errors.Is(err, models.ErrJobSuperseded) {
+		return err
+	}
 	if err != nil {
 		return fmt.Errorf("failed to update product: %v", err)
 	}
@@ -155,11 +424,75 @@ func updateProductCompressedImages(productID int, compressedImages []string) err
 	return nil
 }
 
-// to generate unique filename
-func generateUniqueFileName(originalURL string) string {
-	return fmt.Sprintf("%s_%d%s", 
-		filepath.Base(originalURL), 
-		time.Now().UnixNano(), 
-		filepath.Ext(originalURL),
+// short machine readable cause for a failed image
+func imageErrorReason(err error) string {
+	var fetchErr *image.FetchError
+	if errors.As(err, &fetchErr) {
+		return fetchErr.Reason
+	}
+	var formatErr *image.UnsupportedFormatError
+	if errors.As(err, &formatErr) {
+		return "unsupported_format"
+	}
+	var dimensionErr *image.DimensionError
+	if errors.As(err, &dimensionErr) {
+		return "dimensions_exceeded"
+	}
+	return "processing_failed"
+}
+
+// builds a content addressed key, the same bytes and rendition
+// parameters always map to the same object
+func renditionKey(productID int, rendition image.CompressedImage) string {
+	h := sha256.New()
+	spec := rendition.Spec
+	fmt.Fprintf(h, "%s|%dx%d|q%d|%s|", spec.Name, spec.MaxWidth, spec.MaxHeight, spec.Quality, rendition.Format)
+	h.Write(rendition.Data)
+
+	return fmt.Sprintf("products/%d/%s/%s.%s",
+		productID,
+		rendition.Rendition,
+		hex.EncodeToString(h.Sum(nil)),
+		image.Extension(rendition.Format),
 	)
-}
\ No newline at end of file
+}
+
+// uploads data unless an object already exists under key,
+// which makes reprocessing the same images free
+func uploadIfMissing(key string, data []byte, opts blobstore.PutOptions) error {
+	ctx := context.Background()
+	info, err := config.Blob.Head(ctx, key)
+	if err == nil {
+		// an old object may be unreferenced and about to be collected, it's
+		// written again so the garbage collector sees it as new
+		if time.Since(info.LastModified) < config.GCGracePeriod/2 {
+			log.Printf("Object %s already exists, skipping upload", key)
+			return nil
+		}
+		log.Printf("Refreshing object %s last modified %s", key, info.LastModified.Format(time.RFC3339))
+	} else if !errors.Is(err, blobstore.ErrNotFound) {
+		// can't tell, uploading again is still correct
+		log.Printf("WARNING: Failed to check object %s, uploading anyway: %v", key, err)
+	}
+
+	log.Printf("Uploading object with key: %s", key)
+	return config.Blob.Put(ctx, key, data, opts)
+}
+
+// headers and metadata stored with a rendition, the metadata lets an
+// object in the bucket be traced back to its product and source image
+func renditionPutOptions(productID int, sourceURL string, rendition image.CompressedImage) blobstore.PutOptions {
+	sourceHash := sha256.Sum256([]byte(sourceURL))
+	return blobstore.PutOptions{
+		ContentType:  image.ContentType(rendition.Format),
+		CacheControl: config.StorageCacheControl,
+		StorageClass: config.StorageClass,
+		Metadata: map[string]string{
+			"product-id":      strconv.Itoa(productID),
+			"source-url-hash": hex.EncodeToString(sourceHash[:]),
+			"rendition":       rendition.Rendition,
+			"width":           strconv.Itoa(rendition.Width),
+			"height":          strconv.Itoa(rendition.Height),
+		},
+	}
+}
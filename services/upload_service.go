@@ -0,0 +1,145 @@
+package services
+
+import (
+	"AsyncProd/config"
+	"AsyncProd/pkg/blobstore"
+	"AsyncProd/pkg/image"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrUploadNotFound    = errors.New("uploaded object not found")
+	ErrUploadInvalid     = errors.New("uploaded object is not acceptable")
+	ErrUploadUnsupported = errors.New("the storage backend does not support direct uploads")
+)
+
+// a presigned PUT the client uploads an original to
+type PresignedUpload struct {
+	Key         string    `json:"key"`
+	URL         string    `json:"url"`
+	ContentType string    `json:"content_type"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// stores an uploaded original under products/{id}/originals/ and
+// returns the s3:// URL the worker reads it back from
+func StoreOriginalImage(ctx context.Context, productID int, data []byte, format string) (string, error) {
+	name, err := randomName()
+	if err != nil {
+		return "", err
+	}
+	key := fmt.Sprintf("%s%s.%s", originalsPrefix(productID), name, image.Extension(format))
+
+	err = config.Blob.Put(ctx, key, data, blobstore.PutOptions{
+		ContentType:  image.ContentType(format),
+		CacheControl: config.StorageCacheControl,
+		StorageClass: config.StorageClass,
+		Metadata:     map[string]string{"product-id": strconv.Itoa(productID)},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to upload original image: %v", err)
+	}
+	log.Printf("SUCCESS: Stored original image for product ID %d: %s", productID, key)
+
+	return objectSourceURL(key), nil
+}
+
+// creates a presigned PUT URL for a new original of the product,
+// the client has to upload with the Content-Type returned alongside it
+func PresignOriginalUpload(productID int, contentType string) (*PresignedUpload, error) {
+	presigner, ok := config.Blob.(blobstore.Presigner)
+	if !ok {
+		return nil, ErrUploadUnsupported
+	}
+
+	format := image.NormalizeFormat(strings.TrimPrefix(contentType, "image/"))
+	if !strings.HasPrefix(contentType, "image/") || image.ContentType(format) == "application/octet-stream" {
+		return nil, fmt.Errorf("%w: content type %q is not a supported image", ErrUploadInvalid, contentType)
+	}
+	contentType = image.ContentType(format)
+
+	name, err := randomName()
+	if err != nil {
+		return nil, err
+	}
+	key := fmt.Sprintf("%s%s.%s", originalsPrefix(productID), name, image.Extension(format))
+
+	url, err := presigner.PresignPut(key, contentType, config.UploadPresignExpiry)
+	if err != nil {
+		return nil, fmt.Errorf("failed to presign upload: %v", err)
+	}
+
+	return &PresignedUpload{
+		Key:         key,
+		URL:         url,
+		ContentType: contentType,
+		ExpiresAt:   time.Now().Add(config.UploadPresignExpiry),
+	}, nil
+}
+
+// checks that a presigned upload arrived and is a real image within the
+// size limit, returns the s3:// URL to add to the product
+func ConfirmOriginalUpload(ctx context.Context, productID int, key string) (string, error) {
+	if !strings.HasPrefix(key, originalsPrefix(productID)) || strings.Contains(key, "..") {
+		return "", fmt.Errorf("%w: key %s does not belong to product %d", ErrUploadInvalid, key, productID)
+	}
+
+	head, err := config.Blob.Head(ctx, key)
+	if err != nil {
+		if errors.Is(err, blobstore.ErrNotFound) {
+			return "", fmt.Errorf("%w: %s", ErrUploadNotFound, key)
+		}
+		return "", fmt.Errorf("failed to check upload %s: %v", key, err)
+	}
+	if head.Size > config.UploadMaxBytes {
+		deleteObject(ctx, key)
+		return "", fmt.Errorf("%w: %s is larger than %d bytes", ErrUploadInvalid, key, config.UploadMaxBytes)
+	}
+
+	// the leading bytes are enough to tell whether this is an image
+	body, _, err := config.Blob.Get(ctx, key)
+	if err != nil {
+		return "", fmt.Errorf("failed to read upload %s: %v", key, err)
+	}
+	defer body.Close()
+	header, err := io.ReadAll(io.LimitReader(body, 32))
+	if err != nil {
+		return "", fmt.Errorf("failed to read upload %s: %v", key, err)
+	}
+	if image.DetectFormat(header) == "" {
+		deleteObject(ctx, key)
+		return "", fmt.Errorf("%w: %s is not a supported image", ErrUploadInvalid, key)
+	}
+
+	return objectSourceURL(key), nil
+}
+
+// best effort removal of a rejected upload
+func deleteObject(ctx context.Context, key string) {
+	err := config.Blob.Delete(ctx, key)
+	if err != nil {
+		log.Printf("ERROR: Failed to delete rejected upload %s: %v", key, err)
+	}
+}
+
+// where a product's original uploads live
+func originalsPrefix(productID int) string {
+	return fmt.Sprintf("products/%d/originals/", productID)
+}
+
+func randomName() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate file name: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}